@@ -0,0 +1,265 @@
+package main
+
+import (
+	"cloud.google.com/go/pubsub"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	gst "rtp-audio-processor/gstreamer-src"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// alertAudioPadding widens the audio linked from an alert around the phrase
+const alertAudioPadding = time.Second * 2
+
+// AlertEvent is published when a transcript or a final live caption contains a phrase of a keyword list.
+type AlertEvent struct {
+	PipelineId string
+	Endpoint   string
+	List       string
+	Phrase     string
+	Transcript string
+	StartTime  time.Time
+	EndTime    time.Time
+	// Source is "transcript" for completed recognitions (of RequestId) and "captions" for live ones
+	Source    string
+	RequestId string `json:",omitempty"`
+	// AudioUrl exports the bookmarked audio of the phrase while the bookmark is kept: the bookmark of the
+	// recognition request, or one made around the phrase of a live caption
+	AudioUrl string `json:",omitempty"`
+	// AudioUri is the audio stored by the recognition, the phrase is at AudioStartMs to AudioEndMs of it
+	AudioUri     string `json:",omitempty"`
+	AudioStartMs int64  `json:",omitempty"`
+	AudioEndMs   int64  `json:",omitempty"`
+}
+
+// keywordLists are phrases by list name, from ALERT_KEYWORDS_FILE (a JSON object of phrase arrays)
+// and ALERT_KEYWORDS (comma separated phrases of the "default" list). Phrases are kept normalized.
+var keywordLists map[string][][]string
+
+// alertsTopic is the Pub/Sub topic of alert events, alerts are only kept in results when it is not set
+var alertsTopic string
+
+// publicUrl prefixes alert audio links, they are relative when PUBLIC_URL is not set
+var publicUrl string
+
+func init() {
+	lists := make(map[string][]string)
+	if path := os.Getenv("ALERT_KEYWORDS_FILE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			panic(fmt.Sprintf("can not read ALERT_KEYWORDS_FILE: %v", err))
+		}
+		if err := json.Unmarshal(content, &lists); err != nil {
+			panic(fmt.Sprintf("ALERT_KEYWORDS_FILE is not a JSON object of phrase arrays: %v", err))
+		}
+	}
+	if keywords := os.Getenv("ALERT_KEYWORDS"); keywords != "" {
+		lists["default"] = append(lists["default"], strings.Split(keywords, ",")...)
+	}
+
+	keywordLists = make(map[string][][]string, len(lists))
+	for name, phrases := range lists {
+		for _, phrase := range phrases {
+			if words := normalizeWords(phrase); len(words) > 0 {
+				keywordLists[name] = append(keywordLists[name], words)
+			}
+		}
+	}
+	alertsTopic = os.Getenv("ALERTS_TOPIC")
+	publicUrl = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+}
+
+// normalizeWords lower cases text and splits it into words, dropping punctuation.
+func normalizeWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '\''
+	})
+}
+
+// keywordMatch is a phrase found at the words [start, end) of a text.
+type keywordMatch struct {
+	list, phrase string
+	start, end   int
+}
+
+// findKeywords finds the phrases of all keyword lists in words, in the order of the lists and phrases.
+func findKeywords(words []string) []keywordMatch {
+	names := make([]string, 0, len(keywordLists))
+	for name := range keywordLists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var matches []keywordMatch
+	for _, name := range names {
+		for _, phrase := range keywordLists[name] {
+			for start := 0; start+len(phrase) <= len(words); start++ {
+				if wordsEqual(words[start:start+len(phrase)], phrase) {
+					matches = append(matches, keywordMatch{list: name, phrase: strings.Join(phrase, " "), start: start, end: start + len(phrase)})
+				}
+			}
+		}
+	}
+	return matches
+}
+
+func wordsEqual(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// segmentAlerts finds keywords in recognized segments of an endpoint, timed by the words when the recognizer
+// reported them and by the segment otherwise, mapping offsets to capture times by the timeline.
+// The alerts link to the audio of bookmarkId, or to the stored audioUri of the recognition, when there are.
+func segmentAlerts(requestId, pipelineId, endpointId, bookmarkId, audioUri string, segments []Segment, timeline *gst.Timeline) []AlertEvent {
+	if len(keywordLists) == 0 {
+		return nil
+	}
+	var alerts []AlertEvent
+	for _, segment := range segments {
+		var words []string
+		var starts, ends []time.Duration
+		if len(segment.Words) > 0 {
+			for _, word := range segment.Words {
+				for _, normalized := range normalizeWords(word.Word) {
+					words = append(words, normalized)
+					starts = append(starts, word.start())
+					ends = append(ends, word.end())
+				}
+			}
+		} else {
+			words = normalizeWords(segment.Text)
+		}
+
+		for _, match := range findKeywords(words) {
+			start, end := segment.start(), segment.end()
+			if starts != nil {
+				start, end = starts[match.start], ends[match.end-1]
+			}
+			alert := newAlert(pipelineId, endpointId, match, segment.Text,
+				timeline.CaptureTime(start), timeline.CaptureTime(end), "transcript", requestId)
+			if bookmarkId != "" {
+				alert.AudioUrl = bookmarkAudioUrl(bookmarkId, endpointId)
+			}
+			if audioUri != "" {
+				alert.AudioUri = audioUri
+				alert.AudioStartMs = (start - alertAudioPadding).Milliseconds()
+				if alert.AudioStartMs < 0 {
+					alert.AudioStartMs = 0
+				}
+				alert.AudioEndMs = (end + alertAudioPadding).Milliseconds()
+			}
+			alerts = append(alerts, alert)
+		}
+	}
+	return alerts
+}
+
+// captionAlerts finds keywords in a final live caption, bookmarking the audio of the caption while it is
+// still in the ring buffer.
+func captionAlerts(event CaptionEvent) []AlertEvent {
+	if len(keywordLists) == 0 || !event.IsFinal {
+		return nil
+	}
+	var alerts []AlertEvent
+	for _, match := range findKeywords(normalizeWords(event.Transcript)) {
+		alerts = append(alerts, newAlert(event.PipelineId, event.Endpoint, match, event.Transcript, event.StartTime, event.EndTime, "captions", ""))
+	}
+	if len(alerts) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	bookmark, err := gst.CreateBookmark(event.PipelineId, []string{event.Endpoint},
+		now.Sub(event.StartTime.Add(-alertAudioPadding)), event.EndTime.Add(alertAudioPadding).Sub(now))
+	if err != nil {
+		fmt.Printf("can not bookmark alert audio(id=%s, endpoint=%s): %v\n", event.PipelineId, event.Endpoint, err)
+		return alerts
+	}
+	for i := range alerts {
+		alerts[i].AudioUrl = bookmarkAudioUrl(bookmark.Id, event.Endpoint)
+	}
+	return alerts
+}
+
+// bookmarkAudioUrl exports the bookmarked audio of the endpoint.
+func bookmarkAudioUrl(bookmarkId, endpointId string) string {
+	query := url.Values{}
+	query.Set("bookmarkId", bookmarkId)
+	query.Set("endpoints", endpointId)
+	return publicUrl + "/pipeline/export?" + query.Encode()
+}
+
+func newAlert(pipelineId, endpointId string, match keywordMatch, transcript string, start, end time.Time, source, requestId string) AlertEvent {
+	return AlertEvent{
+		PipelineId: pipelineId,
+		Endpoint:   endpointId,
+		List:       match.list,
+		Phrase:     match.phrase,
+		Transcript: transcript,
+		StartTime:  start,
+		EndTime:    end,
+		Source:     source,
+		RequestId:  requestId,
+	}
+}
+
+// publishAlerts publishes alert events to alertsTopic in the background.
+func publishAlerts(alerts []AlertEvent) {
+	if len(alerts) == 0 {
+		return
+	}
+	for _, alert := range alerts {
+		fmt.Printf("keyword alert(id=%s, endpoint=%s, list=%s, phrase=%q)\n", alert.PipelineId, alert.Endpoint, alert.List, alert.Phrase)
+	}
+	if alertsTopic == "" {
+		return
+	}
+
+	deliveries.Add(1)
+	go func() {
+		defer deliveries.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		client, err := getPubsubPublisher(ctx)
+		if err != nil {
+			fmt.Printf("can not publish alerts: %v\n", err)
+			return
+		}
+		topic := client.Topic(alertsTopic)
+		defer topic.Stop()
+
+		var published []*pubsub.PublishResult
+		for _, alert := range alerts {
+			data, err := json.Marshal(alert)
+			if err != nil {
+				fmt.Printf("can not marshal alert event: %v\n", err)
+				continue
+			}
+			published = append(published, topic.Publish(ctx, &pubsub.Message{
+				Data: data,
+				Attributes: map[string]string{
+					"eventName":  "alert",
+					"pipelineId": alert.PipelineId,
+					"endpoint":   alert.Endpoint,
+					"list":       alert.List,
+				},
+			}))
+		}
+		for _, result := range published {
+			if _, err := result.Get(ctx); err != nil {
+				fmt.Printf("can not publish alert event: %v\n", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	gst "rtp-audio-processor/gstreamer-src"
+	"testing"
+	"time"
+)
+
+func TestSegmentAlertsAudio(t *testing.T) {
+	defer func(lists map[string][][]string, url string) { keywordLists, publicUrl = lists, url }(keywordLists, publicUrl)
+	keywordLists = map[string][][]string{"default": {{"refund"}}}
+	publicUrl = "https://audio.example.com"
+
+	start := time.Unix(1000, 0)
+	timeline := gst.NewTimeline(gst.Chunk{Time: start, Data: make([]byte, 10*gst.SampleRate*gst.BytesPerSample)})
+	segments := []Segment{{StartMs: 0, EndMs: 6000, Text: "I want a refund", Words: []Word{
+		{Word: "I", StartMs: 1000, EndMs: 1200},
+		{Word: "want", StartMs: 1200, EndMs: 1500},
+		{Word: "a", StartMs: 1500, EndMs: 1600},
+		{Word: "refund", StartMs: 5000, EndMs: 5600},
+	}}}
+
+	tests := []struct {
+		name                 string
+		bookmarkId, audioUri string
+		audioUrl             string
+		audioStart, audioEnd int64
+	}{
+		{"no audio", "", "", "", 0, 0},
+		{"bookmark", "42", "", "https://audio.example.com/pipeline/export?bookmarkId=42&endpoints=e1", 0, 0},
+		{"stored audio", "", "gs://bucket/r1.flac", "", 3000, 7600},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			alerts := segmentAlerts("r1", "p1", "e1", test.bookmarkId, test.audioUri, segments, timeline)
+			if len(alerts) != 1 {
+				t.Fatalf("%v alerts, want 1", len(alerts))
+			}
+			alert := alerts[0]
+			if !alert.StartTime.Equal(start.Add(5*time.Second)) || !alert.EndTime.Equal(start.Add(5600*time.Millisecond)) {
+				t.Errorf("alert from %v to %v", alert.StartTime, alert.EndTime)
+			}
+			if alert.AudioUrl != test.audioUrl || alert.AudioUri != test.audioUri ||
+				alert.AudioStartMs != test.audioStart || alert.AudioEndMs != test.audioEnd {
+				t.Errorf("alert audio %q %q %v-%v, want %q %q %v-%v", alert.AudioUrl, alert.AudioUri, alert.AudioStartMs, alert.AudioEndMs,
+					test.audioUrl, test.audioUri, test.audioStart, test.audioEnd)
+			}
+		})
+	}
+}
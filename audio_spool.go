@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// audioSpool keeps exported audio while it is recognized, so uploads can be retried and recognizers can read it
+// back. Audio up to limit bytes stays in memory, longer audio goes to a temporary file.
+type audioSpool struct {
+	limit  int64
+	memory []byte
+	file   *os.File
+	size   int64
+}
+
+func newAudioSpool(limit int64) *audioSpool {
+	return &audioSpool{limit: limit}
+}
+
+func (s *audioSpool) Write(p []byte) (int, error) {
+	if s.file == nil && s.size+int64(len(p)) > s.limit {
+		file, err := os.CreateTemp("", "audio-*.pcm")
+		if err != nil {
+			return 0, err
+		}
+		s.file = file
+		if _, err := s.file.Write(s.memory); err != nil {
+			return 0, err
+		}
+		s.memory = nil
+	}
+	if s.file != nil {
+		n, err := s.file.Write(p)
+		s.size += int64(n)
+		return n, err
+	}
+	s.memory = append(s.memory, p...)
+	s.size += int64(len(p))
+	return len(p), nil
+}
+
+// inMemory tells whether the audio fits the limit, then bytes returns it.
+func (s *audioSpool) inMemory() bool {
+	return s.file == nil
+}
+
+func (s *audioSpool) bytes() []byte {
+	return s.memory
+}
+
+// open reads the audio from the start, it can be called again for every retry.
+func (s *audioSpool) open() io.Reader {
+	if s.file != nil {
+		return io.NewSectionReader(s.file, 0, s.size)
+	}
+	return bytes.NewReader(s.memory)
+}
+
+// Close removes the temporary file.
+func (s *audioSpool) Close() error {
+	s.memory = nil
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
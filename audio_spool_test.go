@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestAudioSpool(t *testing.T) {
+	tests := []struct {
+		name     string
+		writes   []int
+		inMemory bool
+	}{
+		{"empty", nil, true},
+		{"within the limit", []int{100, 900}, true},
+		{"beyond the limit", []int{600, 600, 600}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spool := newAudioSpool(1000)
+			var written []byte
+			for i, size := range test.writes {
+				data := bytes.Repeat([]byte{byte(i + 1)}, size)
+				if _, err := spool.Write(data); err != nil {
+					t.Fatal(err)
+				}
+				written = append(written, data...)
+			}
+			if spool.inMemory() != test.inMemory {
+				t.Errorf("in memory %v, want %v", spool.inMemory(), test.inMemory)
+			}
+			// every reader reads all of it
+			for i := 0; i < 2; i++ {
+				read, err := io.ReadAll(spool.open())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(read, written) || spool.size != int64(len(written)) {
+					t.Errorf("read %v bytes of size %v, want %v", len(read), spool.size, len(written))
+				}
+			}
+
+			var name string
+			if spool.file != nil {
+				name = spool.file.Name()
+			}
+			if err := spool.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if name != "" {
+				if _, err := os.Stat(name); !os.IsNotExist(err) {
+					t.Errorf("temporary file %v left behind", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	gst "rtp-audio-processor/gstreamer-src"
+	"time"
+)
+
+const defaultBookmarkSeconds = 60
+
+// bookmarkHandler creates bookmarks (POST id, endpoint, before/after seconds) and lists them
+// (GET bookmarkId, or id to filter by pipeline).
+func bookmarkHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if hasRequestParam(r, "bookmarkId") {
+			bookmarkId, err := getRequestParam(r, "bookmarkId")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			bookmark, err := gst.GetBookmark(bookmarkId)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			writeJson(w, bookmark)
+			return
+		}
+
+		pipelineId := ""
+		if hasRequestParam(r, "id") {
+			var err error
+			pipelineId, err = getRequestParam(r, "id")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		writeJson(w, gst.ListBookmarks(pipelineId))
+	case http.MethodPost:
+		id, err := getRequestParam(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var endpointIds []string
+		if hasRequestParam(r, "endpoint") {
+			endpoint, err := getRequestParam(r, "endpoint")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			endpointIds = []string{endpoint}
+		}
+
+		before, after := defaultBookmarkSeconds, defaultBookmarkSeconds
+		if hasRequestParam(r, "before") {
+			if before, err = getRequestParamInt(r, "before"); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if hasRequestParam(r, "after") {
+			if after, err = getRequestParamInt(r, "after"); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		window := time.Duration(before+after) * time.Second
+		if before < 0 || after < 0 || window > gst.RingBufferDuration {
+			http.Error(w, "before and after must not be negative and must fit the ring buffer", http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("CreateBookmark(id=%s, endpoints=%v, before=%d, after=%d)\n", id, endpointIds, before, after)
+		bookmark, err := gst.CreateBookmark(id, endpointIds, time.Duration(before)*time.Second, time.Duration(after)*time.Second)
+		if err != nil {
+			http.Error(w, err.Error(), exportErrorCode(err))
+			return
+		}
+		writeJson(w, bookmark)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
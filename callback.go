@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"cloud.google.com/go/pubsub"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// callbackAttempts is how many times a result delivery is tried, waiting callbackBackoff (doubling) in between
+const callbackAttempts = 5
+const callbackBackoff = time.Second * 2
+
+// callbackSecret signs delivered results: hex HMAC-SHA256 of the body in the X-Signature header
+// (signature attribute for Pub/Sub). Deliveries are unsigned when CALLBACK_SECRET is not set.
+var callbackSecret []byte
+
+// callbackAllowedHosts are the only hosts results are delivered to when CALLBACK_ALLOWED_HOSTS (comma separated)
+// is set. Otherwise callbacks to loopback, private and link-local addresses are refused, also after DNS resolution,
+// so requests can not reach internal services through callbacks.
+var callbackAllowedHosts map[string]bool
+var callbackClient *http.Client
+
+// deliveries are the results and alerts being delivered in the background, waited for on shutdown
+var deliveries sync.WaitGroup
+
+var pubsubPublisher *pubsub.Client
+var pubsubPublisherClosed bool
+var pubsubPublisherMutex sync.Mutex
+
+func init() {
+	callbackSecret = []byte(os.Getenv("CALLBACK_SECRET"))
+	if hosts := os.Getenv("CALLBACK_ALLOWED_HOSTS"); hosts != "" {
+		callbackAllowedHosts = make(map[string]bool)
+		for _, host := range strings.Split(hosts, ",") {
+			callbackAllowedHosts[strings.ToLower(strings.TrimSpace(host))] = true
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: time.Second * 30, Control: checkCallbackAddress}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	callbackClient = &http.Client{Timeout: time.Second * 30, Transport: transport}
+}
+
+// validateCallbackUrl accepts absolute http(s) urls of allowed hosts, or of any host which is not an internal address.
+func validateCallbackUrl(callbackUrl string) error {
+	parsed, err := url.Parse(callbackUrl)
+	if err != nil {
+		return fmt.Errorf("invalid callbackUrl: %w", err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid callbackUrl %v: must be an absolute http(s) url", callbackUrl)
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if callbackAllowedHosts != nil {
+		if !callbackAllowedHosts[host] {
+			return fmt.Errorf("invalid callbackUrl %v: host %v is not allowed", callbackUrl, host)
+		}
+		return nil
+	}
+	if ip := net.ParseIP(host); host == "localhost" || strings.HasSuffix(host, ".localhost") || (ip != nil && internalAddress(ip)) {
+		return fmt.Errorf("invalid callbackUrl %v: host %v is an internal address", callbackUrl, host)
+	}
+	return nil
+}
+
+func internalAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified()
+}
+
+// checkCallbackAddress refuses connections to internal addresses, which hosts may resolve to.
+// Allowed hosts are trusted, they may be internal services.
+func checkCallbackAddress(network, address string, _ syscall.RawConn) error {
+	if callbackAllowedHosts != nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return &permanentError{err}
+	}
+	if ip := net.ParseIP(host); ip == nil || internalAddress(ip) {
+		return &permanentError{fmt.Errorf("callback address %v is internal", host)}
+	}
+	return nil
+}
+
+func signPayload(payload []byte) string {
+	if len(callbackSecret) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, callbackSecret)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverResultInBackground delivers the result without holding up the caller, e.g. a recognition worker
+// while a dead callback url is retried.
+func deliverResultInBackground(result Result) {
+	deliveries.Add(1)
+	go func() {
+		defer deliveries.Done()
+		deliverResult(result)
+	}()
+}
+
+// deliverResult sends the finished result to its callback url and Pub/Sub topic, recording delivery failures in the result.
+func deliverResult(result Result) {
+	if result.CallbackUrl == "" && result.PubsubTopic == "" {
+		return
+	}
+	payload, err := json.Marshal(result)
+	if err != nil {
+		fmt.Printf("can not marshal result %v: %v\n", result.RequestId, err)
+		return
+	}
+	signature := signPayload(payload)
+
+	var errs []string
+	if result.CallbackUrl != "" {
+		if err := retryDelivery(func(ctx context.Context) error {
+			return postCallback(ctx, result.CallbackUrl, payload, signature)
+		}); err != nil {
+			errs = append(errs, fmt.Sprintf("callback %v: %v", result.CallbackUrl, err))
+		}
+	}
+	if result.PubsubTopic != "" {
+		if err := retryDelivery(func(ctx context.Context) error {
+			return publishResult(ctx, result.PubsubTopic, result.RequestId, payload, signature)
+		}); err != nil {
+			errs = append(errs, fmt.Sprintf("pubsub topic %v: %v", result.PubsubTopic, err))
+		}
+	}
+	if len(errs) > 0 {
+		fmt.Printf("result %v delivery failed: %v\n", result.RequestId, errs)
+		results.Update(result.RequestId, func(result *Result) {
+			result.CallbackError = fmt.Sprint(errs)
+		})
+	}
+}
+
+// permanentError stops retryDelivery, e.g. when the callback rejects the request itself.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func retryDelivery(deliver func(ctx context.Context) error) error {
+	backoff := callbackBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err = deliver(ctx)
+		cancel()
+		var permanent *permanentError
+		if err == nil || errors.As(err, &permanent) || attempt == callbackAttempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postCallback(ctx context.Context, callbackUrl string, payload []byte, signature string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackUrl, bytes.NewReader(payload))
+	if err != nil {
+		return &permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if signature != "" {
+		req.Header.Set("X-Signature", signature)
+	}
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1024))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return &permanentError{fmt.Errorf("callback responded %v", resp.Status)}
+	default:
+		return fmt.Errorf("callback responded %v", resp.Status)
+	}
+}
+
+// getPubsubPublisher returns the client shared by everything publishing to Pub/Sub, created on first use.
+func getPubsubPublisher(ctx context.Context) (*pubsub.Client, error) {
+	pubsubPublisherMutex.Lock()
+	defer pubsubPublisherMutex.Unlock()
+
+	if pubsubPublisherClosed {
+		return nil, &permanentError{errClientClosed}
+	}
+	if pubsubPublisher == nil {
+		projectId := os.Getenv("GCLOUD_PROJECT_ID")
+		if projectId == "" {
+			return nil, &permanentError{errors.New("environment variable GCLOUD_PROJECT_ID is not set")}
+		}
+		client, err := pubsub.NewClient(ctx, projectId)
+		if err != nil {
+			return nil, err
+		}
+		pubsubPublisher = client
+	}
+	return pubsubPublisher, nil
+}
+
+func closePubsubPublisher() {
+	pubsubPublisherMutex.Lock()
+	defer pubsubPublisherMutex.Unlock()
+
+	pubsubPublisherClosed = true
+	if pubsubPublisher != nil {
+		if err := pubsubPublisher.Close(); err != nil {
+			fmt.Printf("can not close pubsub publisher: %v\n", err)
+		}
+		pubsubPublisher = nil
+	}
+}
+
+func publishResult(ctx context.Context, topicId, requestId string, payload []byte, signature string) error {
+	client, err := getPubsubPublisher(ctx)
+	if err != nil {
+		return err
+	}
+	attributes := map[string]string{"requestId": requestId}
+	if signature != "" {
+		attributes["signature"] = signature
+	}
+	topic := client.Topic(topicId)
+	defer topic.Stop()
+	_, err = topic.Publish(ctx, &pubsub.Message{Data: payload, Attributes: attributes}).Get(ctx)
+	return err
+}
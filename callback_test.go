@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateCallbackUrl(t *testing.T) {
+	tests := []struct {
+		url          string
+		allowedHosts map[string]bool
+		valid        bool
+	}{
+		{"https://example.com/callback", nil, true},
+		{"http://203.0.113.7:8080/callback", nil, true},
+		{"ftp://example.com/callback", nil, false},
+		{"/callback", nil, false},
+		{"http://localhost:8080/callback", nil, false},
+		{"http://127.0.0.1/callback", nil, false},
+		{"http://[::1]/callback", nil, false},
+		{"http://10.1.2.3/callback", nil, false},
+		{"http://192.168.0.10/callback", nil, false},
+		{"http://169.254.169.254/computeMetadata/v1/", nil, false},
+		{"http://0.0.0.0/callback", nil, false},
+		{"http://results.internal/callback", map[string]bool{"results.internal": true}, true},
+		{"https://example.com/callback", map[string]bool{"results.internal": true}, false},
+	}
+	defer func(hosts map[string]bool) { callbackAllowedHosts = hosts }(callbackAllowedHosts)
+	for _, test := range tests {
+		callbackAllowedHosts = test.allowedHosts
+		if err := validateCallbackUrl(test.url); (err == nil) != test.valid {
+			t.Errorf("validateCallbackUrl(%v) = %v, want valid %v", test.url, err, test.valid)
+		}
+	}
+}
+
+func TestCallbackRefusesInternalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	defer func(hosts map[string]bool) { callbackAllowedHosts = hosts }(callbackAllowedHosts)
+	callbackAllowedHosts = nil
+	err := postCallback(context.Background(), server.URL, []byte("{}"), "")
+	var permanent *permanentError
+	if !errors.As(err, &permanent) {
+		t.Errorf("callback to %v: error %v, want a permanent error", server.URL, err)
+	}
+
+	callbackAllowedHosts = map[string]bool{"127.0.0.1": true}
+	if err := postCallback(context.Background(), server.URL, []byte("{}"), ""); err != nil {
+		t.Errorf("callback to allowed host: %v", err)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"cloud.google.com/go/pubsub"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	gst "rtp-audio-processor/gstreamer-src"
+	"sort"
+	"sync"
+	"time"
+)
+
+// captionsSyncInterval is how often a captions session catches up with speakers whose audio appeared late
+const captionsSyncInterval = time.Second * 5
+
+// CaptionEvent is published for every interim and final live recognition result.
+type CaptionEvent struct {
+	PipelineId   string
+	Endpoint     string
+	Transcript   string
+	IsFinal      bool
+	Stability    float32
+	Confidence   float32
+	StartTime    time.Time
+	EndTime      time.Time
+	LanguageCode string
+}
+
+type CaptionsState struct {
+	PipelineId   string
+	LanguageCode string
+	Recognizer   string
+	PubsubTopic  string
+	RedactPii    bool `json:",omitempty"`
+	Endpoints    []string
+}
+
+// captionsSession streams the audio of every speaker of a pipeline to a streaming recognizer.
+type captionsSession struct {
+	pipelineId     string
+	recognizerName string
+	recognizer     StreamingRecognizer
+	config         *RecognitionConfig
+	redactPii      bool // mask emails, phone and card numbers in the caption and alert events
+	topic          *pubsub.Topic
+	taps           map[ /*endpointId*/ string]*gst.Tap
+	ctx            context.Context
+	cancel         context.CancelFunc
+	lock           sync.Mutex
+}
+
+var captionsSessions map[string]*captionsSession
+var captionsSessionsMutex sync.Mutex
+
+// captionsTopic is the default Pub/Sub topic for caption events
+var captionsTopic string
+
+func init() {
+	captionsSessions = make(map[string]*captionsSession)
+	captionsTopic = os.Getenv("CAPTIONS_TOPIC")
+}
+
+// updatePipeline updates the pipeline and starts or stops live captions of the speakers which changed.
+func updatePipeline(id string, ssrcEndpointMap map[int]string, speakers []string) error {
+	if err := gst.UpdatePipeline(id, ssrcEndpointMap, speakers); err != nil {
+		return err
+	}
+	captionsSessionsMutex.Lock()
+	session, ok := captionsSessions[id]
+	captionsSessionsMutex.Unlock()
+	if ok {
+		session.sync()
+	}
+	return nil
+}
+
+func getStreamingRecognizer(name string) (StreamingRecognizer, error) {
+	recognizer, err := getRecognizer(name)
+	if err != nil {
+		return nil, err
+	}
+	streamingRecognizer, ok := recognizer.(StreamingRecognizer)
+	if !ok {
+		return nil, fmt.Errorf("recognizer %v does not support live recognition", name)
+	}
+	return streamingRecognizer, nil
+}
+
+func startCaptions(pipelineId, recognizerName string, recognizer StreamingRecognizer, topicId string, config *RecognitionConfig, redactPii bool) (CaptionsState, error) {
+	if _, ok := livePipelineState(pipelineId); !ok {
+		return CaptionsState{}, gst.NewPipelineNotFoundError(pipelineId)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	client, err := getPubsubPublisher(ctx)
+	if err != nil {
+		cancel()
+		return CaptionsState{}, err
+	}
+
+	session := &captionsSession{
+		pipelineId:     pipelineId,
+		recognizerName: recognizerName,
+		recognizer:     recognizer,
+		config:         config,
+		redactPii:      redactPii,
+		topic:          client.Topic(topicId),
+		taps:           make(map[string]*gst.Tap),
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+
+	captionsSessionsMutex.Lock()
+	oldSession, ok := captionsSessions[pipelineId]
+	captionsSessions[pipelineId] = session
+	captionsSessionsMutex.Unlock()
+	if ok {
+		oldSession.stop()
+	}
+
+	session.sync()
+	go func() {
+		ticker := time.NewTicker(captionsSyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				session.sync()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return session.state(), nil
+}
+
+func stopCaptions(pipelineId string) error {
+	captionsSessionsMutex.Lock()
+	session, ok := captionsSessions[pipelineId]
+	delete(captionsSessions, pipelineId)
+	captionsSessionsMutex.Unlock()
+	if !ok {
+		return gst.NewPipelineNotFoundError(pipelineId)
+	}
+	session.stop()
+	return nil
+}
+
+func livePipelineState(pipelineId string) (gst.PipelineState, bool) {
+	for _, state := range gst.InspectPipelines(pipelineId) {
+		if state.DeletedAt == nil {
+			return state, true
+		}
+	}
+	return gst.PipelineState{}, false
+}
+
+// sync taps speakers which are not captioned yet and closes taps of endpoints which stopped speaking.
+// The session ends together with the pipeline.
+func (s *captionsSession) sync() {
+	state, ok := livePipelineState(s.pipelineId)
+	if !ok {
+		captionsSessionsMutex.Lock()
+		if captionsSessions[s.pipelineId] == s {
+			delete(captionsSessions, s.pipelineId)
+		}
+		captionsSessionsMutex.Unlock()
+		s.stop()
+		return
+	}
+
+	speakers := make(map[string]bool, len(state.Speakers))
+	for _, endpointId := range state.Speakers {
+		speakers[endpointId] = true
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.ctx.Err() != nil {
+		return
+	}
+	for endpointId, tap := range s.taps {
+		if !speakers[endpointId] {
+			tap.Close()
+			delete(s.taps, endpointId)
+		}
+	}
+	for endpointId := range speakers {
+		if _, ok := s.taps[endpointId]; ok {
+			continue
+		}
+		tap, err := gst.TapEndpoint(s.pipelineId, endpointId)
+		if err != nil {
+			// the endpoint audio did not arrive yet
+			continue
+		}
+		s.taps[endpointId] = tap
+		go s.caption(endpointId, tap)
+	}
+}
+
+// caption recognizes the endpoint audio until its tap is closed.
+func (s *captionsSession) caption(endpointId string, tap *gst.Tap) {
+	log.Printf("captions started(id=%s, endpoint=%s)\n", s.pipelineId, endpointId)
+	err := s.recognizer.RecognizeStream(s.ctx, tap.Chunks, s.config, func(result StreamingResult) {
+		event := s.event(endpointId, result)
+		s.publish(event)
+		publishAlerts(captionAlerts(event))
+	})
+	log.Printf("captions stopped(id=%s, endpoint=%s), reason = %v\n", s.pipelineId, endpointId, err)
+
+	// a failed recognition is started again by the next sync
+	s.lock.Lock()
+	if s.taps[endpointId] == tap {
+		tap.Close()
+		delete(s.taps, endpointId)
+	}
+	s.lock.Unlock()
+}
+
+// event makes the caption event of a result, with its PII masked when the session redacts it.
+func (s *captionsSession) event(endpointId string, result StreamingResult) CaptionEvent {
+	transcript := result.Transcript
+	if s.redactPii {
+		transcript = maskPii(transcript, piiMatches(transcript))
+	}
+	return CaptionEvent{
+		PipelineId:   s.pipelineId,
+		Endpoint:     endpointId,
+		Transcript:   transcript,
+		IsFinal:      result.IsFinal,
+		Stability:    result.Stability,
+		Confidence:   result.Confidence,
+		StartTime:    result.StartTime,
+		EndTime:      result.EndTime,
+		LanguageCode: result.LanguageCode,
+	}
+}
+
+func (s *captionsSession) publish(event CaptionEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		fmt.Printf("can not marshal caption event: %v\n", err)
+		return
+	}
+	result := s.topic.Publish(context.Background(), &pubsub.Message{
+		Data: data,
+		Attributes: map[string]string{
+			"eventName":  "caption",
+			"pipelineId": event.PipelineId,
+			"endpoint":   event.Endpoint,
+		},
+	})
+	go func() {
+		if _, err := result.Get(context.Background()); err != nil {
+			fmt.Printf("can not publish caption event: %v\n", err)
+		}
+	}()
+}
+
+func (s *captionsSession) stop() {
+	s.lock.Lock()
+	if s.ctx.Err() != nil {
+		s.lock.Unlock()
+		return
+	}
+	s.cancel()
+	for endpointId, tap := range s.taps {
+		tap.Close()
+		delete(s.taps, endpointId)
+	}
+	s.lock.Unlock()
+	s.topic.Stop()
+}
+
+func (s *captionsSession) state() CaptionsState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	endpointIds := make([]string, 0, len(s.taps))
+	for endpointId := range s.taps {
+		endpointIds = append(endpointIds, endpointId)
+	}
+	sort.Strings(endpointIds)
+	return CaptionsState{
+		PipelineId:   s.pipelineId,
+		LanguageCode: s.config.LanguageCode,
+		Recognizer:   s.recognizerName,
+		PubsubTopic:  s.topic.ID(),
+		RedactPii:    s.redactPii,
+		Endpoints:    endpointIds,
+	}
+}
+
+// captionsHandler turns live captions of a pipeline on (POST id, recognition config params, recognizer, pubsubTopic,
+// redactPii) and off (DELETE id), or describes them (GET id).
+func captionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getRequestParam(r, "id")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		captionsSessionsMutex.Lock()
+		session, ok := captionsSessions[id]
+		captionsSessionsMutex.Unlock()
+		if !ok {
+			http.Error(w, gst.NewPipelineNotFoundError(id).Error(), http.StatusNotFound)
+			return
+		}
+		writeJson(w, session.state())
+	case http.MethodPost:
+		config, err := parseRecognitionConfig(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		recognizerName := defaultRecognizer
+		if hasRequestParam(r, "recognizer") {
+			recognizerName, err = getRequestParam(r, "recognizer")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		recognizer, err := getStreamingRecognizer(recognizerName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		topicId := captionsTopic
+		if hasRequestParam(r, "pubsubTopic") {
+			topicId, err = getRequestParam(r, "pubsubTopic")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if topicId == "" {
+			http.Error(w, "pubsubTopic param error, environment variable CAPTIONS_TOPIC is not set", http.StatusBadRequest)
+			return
+		}
+
+		redactPii := false
+		if hasRequestParam(r, "redactPii") {
+			redactPii, err = getRequestParamBool(r, "redactPii")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		log.Printf("StartCaptions(id=%s, languageCode=%s, recognizer=%s, pubsubTopic=%s, redactPii=%v)\n", id, config.LanguageCode, recognizerName, topicId, redactPii)
+		state, err := startCaptions(id, recognizerName, recognizer, topicId, config, redactPii)
+		if err != nil {
+			http.Error(w, err.Error(), exportErrorCode(err))
+			return
+		}
+		writeJson(w, state)
+	case http.MethodDelete:
+		log.Printf("StopCaptions(id=%s)\n", id)
+		if err := stopCaptions(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "OK")
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// clientHealthInterval is how often the shared clients are checked
+const clientHealthInterval = time.Second * 30
+
+// errClientClosed is returned by shared clients used after shutdown closed them.
+var errClientClosed = errors.New("client is closed by shutdown")
+
+// sharedClient is implemented by recognizers and storages which keep one client for all jobs.
+type sharedClient interface {
+	io.Closer
+	// connect creates the client unless it exists already
+	connect() error
+}
+
+// healthChecker is implemented by clients which can tell whether their service is reachable with a cheap call.
+// Broken connections are reconnected by the clients themselves, on the next call.
+type healthChecker interface {
+	// healthName labels the client in /metrics
+	healthName() string
+	checkHealth(ctx context.Context) error
+}
+
+// clientHealth is the result of the last check of every checked client by its healthName, for /metrics
+var clientHealth = make(map[string]bool)
+var clientHealthMutex sync.Mutex
+
+// stopHealthChecks is closed by closeClients
+var stopHealthChecks chan struct{}
+
+func sharedClients() []sharedClient {
+	var clients []sharedClient
+	for _, recognizer := range recognizers {
+		if client, ok := recognizer.(sharedClient); ok {
+			clients = append(clients, client)
+		}
+	}
+	if client, ok := audioStorage.(sharedClient); ok {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// startClients connects the shared clients of the default recognizer and the storage, and checks them every
+// clientHealthInterval until closeClients. Clients which fail to connect are connected on first use.
+func startClients() {
+	var startup []sharedClient
+	if client, ok := recognizers[defaultRecognizer].(sharedClient); ok {
+		startup = append(startup, client)
+	}
+	if client, ok := audioStorage.(sharedClient); ok {
+		startup = append(startup, client)
+	}
+	for _, client := range startup {
+		if err := client.connect(); err != nil {
+			fmt.Printf("can not connect client: %v\n", err)
+		}
+	}
+
+	var checkers []healthChecker
+	if checker, ok := recognizers[defaultRecognizer].(healthChecker); ok {
+		checkers = append(checkers, checker)
+	}
+	if checker, ok := audioStorage.(healthChecker); ok {
+		checkers = append(checkers, checker)
+	}
+	stopHealthChecks = make(chan struct{})
+	go func(stop <-chan struct{}) {
+		ticker := time.NewTicker(clientHealthInterval)
+		defer ticker.Stop()
+		for {
+			checkClients(checkers)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}(stopHealthChecks)
+}
+
+// checkClients checks every client, logging when its health changes.
+func checkClients(checkers []healthChecker) {
+	for _, checker := range checkers {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		err := checker.checkHealth(ctx)
+		cancel()
+
+		name := checker.healthName()
+		clientHealthMutex.Lock()
+		healthy, checked := clientHealth[name]
+		clientHealth[name] = err == nil
+		clientHealthMutex.Unlock()
+		if err != nil && (healthy || !checked) {
+			fmt.Printf("%v client is unhealthy: %v\n", name, err)
+		} else if err == nil && !healthy && checked {
+			fmt.Printf("%v client is healthy again\n", name)
+		}
+	}
+}
+
+// clientHealthNames returns the checked clients in name order, with their health.
+func clientHealthNames() ([]string, map[string]bool) {
+	clientHealthMutex.Lock()
+	defer clientHealthMutex.Unlock()
+
+	names := make([]string, 0, len(clientHealth))
+	health := make(map[string]bool, len(clientHealth))
+	for name, healthy := range clientHealth {
+		names = append(names, name)
+		health[name] = healthy
+	}
+	sort.Strings(names)
+	return names, health
+}
+
+// closeClients closes the shared clients on shutdown, once the requests, jobs and deliveries using them are done.
+// Closed clients are not created again.
+func closeClients() {
+	if stopHealthChecks != nil {
+		close(stopHealthChecks)
+		stopHealthChecks = nil
+	}
+	for _, client := range sharedClients() {
+		if err := client.Close(); err != nil {
+			fmt.Printf("can not close client: %v\n", err)
+		}
+	}
+	closePubsubPublisher()
+	fmt.Println("shared clients closed")
+}
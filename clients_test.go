@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeHealthChecker struct {
+	err error
+}
+
+func (c *fakeHealthChecker) healthName() string {
+	return "fake"
+}
+
+func (c *fakeHealthChecker) checkHealth(ctx context.Context) error {
+	return c.err
+}
+
+func TestClientHealthMetrics(t *testing.T) {
+	defer func() {
+		clientHealthMutex.Lock()
+		delete(clientHealth, "fake")
+		clientHealthMutex.Unlock()
+	}()
+	metrics := func() string {
+		w := httptest.NewRecorder()
+		metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return w.Body.String()
+	}
+
+	checker := &fakeHealthChecker{err: errors.New("unavailable")}
+	checkClients([]healthChecker{checker})
+	if body := metrics(); !strings.Contains(body, `shared_client_healthy{client="fake"} 0`) {
+		t.Errorf("unhealthy client not in metrics:\n%v", body)
+	}
+	checker.err = nil
+	checkClients([]healthChecker{checker})
+	if body := metrics(); !strings.Contains(body, `shared_client_healthy{client="fake"} 1`) {
+		t.Errorf("healthy client not in metrics:\n%v", body)
+	}
+}
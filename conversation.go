@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	gst "rtp-audio-processor/gstreamer-src"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errEmptyWindow = errors.New("from must be before to")
+var errWindowNotRetained = errors.New("window is outside the retained audio")
+
+// transcriptPause splits the speech of an endpoint into separate transcript entries
+const transcriptPause = time.Second
+
+// TranscriptEntry is a stretch of speech of one endpoint, timed by capture time.
+type TranscriptEntry struct {
+	Endpoint     string
+	StartTime    time.Time
+	EndTime      time.Time
+	Text         string
+	Confidence   float32
+	LanguageCode string `json:",omitempty"`
+}
+
+// conversationHandler transcribes all endpoints (or the given ones) of a pipeline or bookmark into one
+// chronological transcript. Params are those of POST /speech-to-text without endpoint, plus
+// endpoints (comma separated) and from/to (unix ms, last 5 minutes or the bookmark window by default).
+func conversationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	request, err := parseRecognitionRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if hasRequestParam(r, "endpoints") {
+		endpoints, err := getRequestParam(r, "endpoints")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		request.endpointIds = strings.Split(endpoints, ",")
+	}
+	if hasRequestParam(r, "from") {
+		request.from, err = getRequestParamTime(r, "from")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if hasRequestParam(r, "to") {
+		request.to, err = getRequestParamTime(r, "to")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	request.config.EnableWordTimeOffsets = true
+
+	result, err := postConversationRequest(request)
+	if err != nil {
+		http.Error(w, err.Error(), recognitionErrorCode(err))
+		return
+	}
+	marshalResult(result, w)
+}
+
+// exportConversation exports the window of the conversation endpoints, filling in defaults of the request.
+func exportConversation(ctx context.Context, request *recognitionRequest) ([]*gst.ExportReader, error) {
+	if request.bookmarkId != "" {
+		bookmark, err := gst.GetBookmark(request.bookmarkId)
+		if err != nil {
+			return nil, err
+		}
+		request.pipelineId = bookmark.PipelineId
+		if request.endpointIds == nil {
+			request.endpointIds = bookmark.Endpoints
+		}
+		if request.from.IsZero() {
+			request.from = bookmark.From
+		}
+		if request.to.IsZero() {
+			request.to = bookmark.To
+		}
+		if err := checkConversationWindow(request, bookmark.From, bookmark.To); err != nil {
+			return nil, err
+		}
+		return gst.ExportBookmarkWindow(request.bookmarkId, request.endpointIds, request.from, request.to)
+	}
+
+	if request.endpointIds == nil {
+		var err error
+		request.endpointIds, err = gst.PipelineEndpoints(request.pipelineId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if request.to.IsZero() {
+		request.to = time.Now()
+	}
+	if request.from.IsZero() {
+		request.from = request.to.Add(-gst.RingBufferDuration)
+	}
+	now := time.Now()
+	if err := checkConversationWindow(request, now.Add(-gst.RingBufferDuration), now); err != nil {
+		return nil, err
+	}
+	return gst.ExportWindow(ctx, request.pipelineId, request.endpointIds, request.from, request.to)
+}
+
+// checkConversationWindow rejects an empty window and one that does not overlap the audio kept in [from, to).
+func checkConversationWindow(request *recognitionRequest, from, to time.Time) error {
+	if !request.from.Before(request.to) {
+		return errEmptyWindow
+	}
+	if !request.to.After(from) || !request.from.Before(to) {
+		return errWindowNotRetained
+	}
+	return nil
+}
+
+func postConversationRequest(request *recognitionRequest) (Result, error) {
+	if err := recognitions.reserve(); err != nil {
+		return Result{}, err
+	}
+	queuedTime := time.Now()
+	jobCtx, jobCancel := context.WithCancel(context.Background())
+	pcmReaders, err := exportConversation(jobCtx, request)
+	if err != nil {
+		jobCancel()
+		recognitions.release()
+		return Result{}, fmt.Errorf("export pipeline error: %w", err)
+	}
+
+	result := results.Create(&Result{
+		Time:                     queuedTime,
+		Status:                   StatusQueued,
+		QueuedTime:               &queuedTime,
+		PipelineId:               request.pipelineId,
+		BookmarkId:               request.bookmarkId,
+		Endpoints:                request.endpointIds,
+		From:                     &request.from,
+		To:                       &request.to,
+		LanguageCode:             request.config.LanguageCode,
+		AlternativeLanguageCodes: request.config.AlternativeLanguageCodes,
+		Recognizer:               request.recognizerName,
+		CallbackUrl:              request.callbackUrl,
+		PubsubTopic:              request.pubsubTopic,
+	})
+	requestId := result.RequestId
+
+	recognitions.submit(requestId, jobCancel, func() {
+		results.Update(requestId, func(result *Result) {
+			result.setStatus(StatusExporting)
+		})
+		conversation := &conversationProgress{requestId: requestId, progress: make([]int32, len(pcmReaders))}
+		transcripts := make([]endpointTranscript, len(pcmReaders))
+		errs := make([]error, len(pcmReaders))
+		var wg sync.WaitGroup
+		for i, pcmReader := range pcmReaders {
+			wg.Add(1)
+			go func(i int, pcmReader *gst.ExportReader) {
+				defer wg.Done()
+				// every endpoint takes a slot, like a single endpoint job
+				if errs[i] = recognitions.acquire(jobCtx); errs[i] != nil {
+					pcmReader.Close()
+					return
+				}
+				defer recognitions.vacate()
+				transcripts[i], errs[i] = recognizeConversationEndpoint(jobCtx, request, requestId, request.endpointIds[i], pcmReader, conversation, i)
+			}(i, pcmReader)
+		}
+		wg.Wait()
+
+		var transcript []TranscriptEntry
+		var segments []Segment
+		var alerts []AlertEvent
+		var failures []string
+		for i, endpointTranscript := range transcripts {
+			if errs[i] != nil {
+				failures = append(failures, fmt.Sprintf("%v: %v", request.endpointIds[i], errs[i]))
+				continue
+			}
+			transcript = append(transcript, endpointTranscript.entries...)
+			segments = append(segments, endpointTranscript.segments...)
+			alerts = append(alerts, endpointTranscript.alerts...)
+		}
+		sort.SliceStable(transcript, func(i, j int) bool {
+			return transcript[i].StartTime.Before(transcript[j].StartTime)
+		})
+		sort.SliceStable(segments, func(i, j int) bool {
+			return segments[i].StartMs < segments[j].StartMs
+		})
+		sort.SliceStable(alerts, func(i, j int) bool {
+			return alerts[i].StartTime.Before(alerts[j].StartTime)
+		})
+
+		finishRecognition(requestId, func(result *Result) {
+			if len(failures) == len(pcmReaders) && len(failures) > 0 {
+				result.fail(fmt.Sprintf("Recognition error: %v", strings.Join(failures, "; ")))
+				return
+			}
+			if len(failures) > 0 {
+				result.Error = fmt.Sprintf("Recognition error: %v", strings.Join(failures, "; "))
+			}
+			result.Transcript = transcript
+			result.Segments = segments
+			result.Alerts = alerts
+			result.DetectedLanguageCode = transcriptLanguage(transcript)
+			result.setStatus(StatusDone)
+		})
+		publishAlerts(alerts)
+	}, func() {
+		for _, pcmReader := range pcmReaders {
+			pcmReader.Close()
+		}
+	})
+	return result, nil
+}
+
+// conversationProgress reports the average recognition progress over the conversation endpoints.
+type conversationProgress struct {
+	requestId string
+	progress  []int32
+	status    ResultStatus
+	lock      sync.Mutex
+}
+
+func (p *conversationProgress) update(i int, percent int32) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.progress[i] = percent
+	var sum int32
+	for _, percent := range p.progress {
+		sum += percent
+	}
+	results.Update(p.requestId, func(result *Result) {
+		result.Progress = sum / int32(len(p.progress))
+	})
+}
+
+// startUploading moves the result to StatusUploading when the first endpoint gets there.
+func (p *conversationProgress) startUploading() {
+	p.advance(StatusUploading)
+}
+
+// startRecognizing moves the result to StatusRecognizing when the first endpoint gets there.
+func (p *conversationProgress) startRecognizing() {
+	p.advance(StatusRecognizing)
+}
+
+func (p *conversationProgress) advance(status ResultStatus) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.status == status || p.status == StatusRecognizing {
+		return
+	}
+	p.status = status
+	results.Update(p.requestId, func(result *Result) {
+		result.setStatus(status)
+	})
+}
+
+// endpointTranscript is what was recognized of one conversation endpoint.
+type endpointTranscript struct {
+	entries  []TranscriptEntry
+	segments []Segment
+	alerts   []AlertEvent
+}
+
+func recognizeConversationEndpoint(ctx context.Context, request *recognitionRequest, requestId, endpointId string, pcmReader *gst.ExportReader, conversation *conversationProgress, i int) (endpointTranscript, error) {
+	defer pcmReader.Close()
+	storeCtx, storeCancel := context.WithTimeout(ctx, time.Minute*5)
+	defer storeCancel()
+	name := fmt.Sprintf("r%v-p%v-e%v", requestId, request.pipelineId, endpointId)
+	audio, err := prepareAudio(storeCtx, requestId, request, name, pcmReader, conversation.startUploading)
+	if err != nil {
+		return endpointTranscript{}, err
+	}
+	defer audio.release()
+	setConversationAudioUri(requestId, endpointId, audio.keptUri)
+
+	timeline := pcmReader.Timeline()
+	if timeline.Duration() == 0 {
+		// no audio of the endpoint in the window
+		conversation.update(i, 100)
+		return endpointTranscript{}, nil
+	}
+
+	conversation.startRecognizing()
+	segments, err := recognize(ctx, requestId, request, name, audio, func(percent int32) {
+		conversation.update(i, percent)
+	})
+	setConversationAudioUri(requestId, endpointId, audio.keptUri)
+	if err != nil {
+		return endpointTranscript{}, err
+	}
+	conversation.update(i, 100)
+	return endpointTranscript{
+		entries:  transcriptEntries(endpointId, segments, timeline),
+		segments: conversationSegments(endpointId, segments, timeline, request.from),
+		alerts:   segmentAlerts(requestId, request.pipelineId, endpointId, request.bookmarkId, audio.keptUri, segments, timeline),
+	}, nil
+}
+
+// setConversationAudioUri sets or, when uri is empty, removes the audio uri of the endpoint.
+func setConversationAudioUri(requestId, endpointId, uri string) {
+	results.Update(requestId, func(result *Result) {
+		if result.AudioUris[endpointId] == uri {
+			return
+		}
+		audioUris := make(map[string]string, len(result.AudioUris)+1)
+		for id, uri := range result.AudioUris {
+			audioUris[id] = uri
+		}
+		if uri != "" {
+			audioUris[endpointId] = uri
+		} else {
+			delete(audioUris, endpointId)
+		}
+		if len(audioUris) == 0 {
+			audioUris = nil
+		}
+		result.AudioUris = audioUris
+	})
+}
+
+// transcriptEntries turns recognized segments of an endpoint into transcript entries, split on pauses
+// between words, and maps their offsets into the exported audio to capture times.
+func transcriptEntries(endpointId string, segments []Segment, timeline *gst.Timeline) []TranscriptEntry {
+	var entries []TranscriptEntry
+	for _, segment := range segments {
+		if len(segment.Words) == 0 {
+			// recognizers without word offsets
+			if segment.Text != "" {
+				entries = append(entries, TranscriptEntry{
+					Endpoint:     endpointId,
+					StartTime:    timeline.CaptureTime(segment.start()),
+					EndTime:      timeline.CaptureTime(segment.end()),
+					Text:         segment.Text,
+					Confidence:   segment.Confidence,
+					LanguageCode: segment.LanguageCode,
+				})
+			}
+			continue
+		}
+
+		entry := -1
+		var lastWordEnd time.Duration
+		for _, word := range segment.Words {
+			if entry < 0 || word.start()-lastWordEnd > transcriptPause {
+				entries = append(entries, TranscriptEntry{
+					Endpoint:     endpointId,
+					StartTime:    timeline.CaptureTime(word.start()),
+					Confidence:   segment.Confidence,
+					LanguageCode: segment.LanguageCode,
+				})
+				entry = len(entries) - 1
+			} else {
+				entries[entry].Text += " "
+			}
+			entries[entry].Text += word.Word
+			entries[entry].EndTime = timeline.CaptureTime(word.end())
+			lastWordEnd = word.end()
+		}
+	}
+	return entries
+}
+
+// conversationSegments retimes the segments of an endpoint from the start of its recognized audio to the start
+// of the conversation window, so the segments of all endpoints share one timeline.
+func conversationSegments(endpointId string, segments []Segment, timeline *gst.Timeline, from time.Time) []Segment {
+	windowMs := func(ms int64) int64 {
+		return int64(timeline.CaptureTime(time.Duration(ms)*time.Millisecond).Sub(from) / time.Millisecond)
+	}
+	retimed := make([]Segment, 0, len(segments))
+	for _, segment := range segments {
+		segment.Endpoint = endpointId
+		segment.StartMs, segment.EndMs = windowMs(segment.StartMs), windowMs(segment.EndMs)
+		words := make([]Word, len(segment.Words))
+		for i, word := range segment.Words {
+			word.StartMs, word.EndMs = windowMs(word.StartMs), windowMs(word.EndMs)
+			words[i] = word
+		}
+		if len(words) > 0 {
+			segment.Words = words
+		}
+		retimed = append(retimed, segment)
+	}
+	return retimed
+}
+
+// transcriptLanguage is the language most of the transcript was recognized in.
+func transcriptLanguage(transcript []TranscriptEntry) string {
+	lengths := make(map[string]int)
+	for _, entry := range transcript {
+		if entry.LanguageCode != "" {
+			lengths[entry.LanguageCode] += len(entry.Text)
+		}
+	}
+	return longestLanguage(lengths)
+}
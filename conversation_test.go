@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	gst "rtp-audio-processor/gstreamer-src"
+	"testing"
+	"time"
+)
+
+func TestTranscriptEntries(t *testing.T) {
+	start := time.Unix(1000, 0)
+	at := func(ms int64) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	// 4s of audio captured in two parts, 60s apart
+	timeline := gst.NewTimeline(
+		gst.Chunk{Time: start, Data: make([]byte, 2*gst.SampleRate*gst.BytesPerSample)},
+		gst.Chunk{Time: at(62000), Data: make([]byte, 2*gst.SampleRate*gst.BytesPerSample)},
+	)
+
+	tests := []struct {
+		name     string
+		segments []Segment
+		entries  []TranscriptEntry
+	}{
+		{
+			name:     "segment without words",
+			segments: []Segment{{StartMs: 500, EndMs: 1500, Text: "hello there", Confidence: 0.9, LanguageCode: "en-us"}},
+			entries: []TranscriptEntry{
+				{Endpoint: "e1", StartTime: at(500), EndTime: at(1500), Text: "hello there", Confidence: 0.9, LanguageCode: "en-us"},
+			},
+		},
+		{
+			name:     "empty segment",
+			segments: []Segment{{StartMs: 500, EndMs: 1500}},
+		},
+		{
+			name: "words split on pauses",
+			segments: []Segment{{StartMs: 0, EndMs: 4000, Text: "one two three", Confidence: 0.8, Words: []Word{
+				{Word: "one", StartMs: 0, EndMs: 300},
+				{Word: "two", StartMs: 1200, EndMs: 1500},   // 900ms pause
+				{Word: "three", StartMs: 2600, EndMs: 3000}, // 1.1s pause, after the capture gap
+			}}},
+			entries: []TranscriptEntry{
+				{Endpoint: "e1", StartTime: at(0), EndTime: at(1500), Text: "one two", Confidence: 0.8},
+				{Endpoint: "e1", StartTime: at(62600), EndTime: at(63000), Text: "three", Confidence: 0.8},
+			},
+		},
+		{
+			name: "word across the capture gap",
+			segments: []Segment{{Words: []Word{
+				{Word: "long", StartMs: 1800, EndMs: 2200},
+			}}},
+			entries: []TranscriptEntry{
+				{Endpoint: "e1", StartTime: at(1800), EndTime: at(62200), Text: "long"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries := transcriptEntries("e1", test.segments, timeline)
+			if !reflect.DeepEqual(entries, test.entries) {
+				t.Errorf("entries %+v, want %+v", entries, test.entries)
+			}
+		})
+	}
+}
+
+func TestConversationSegments(t *testing.T) {
+	start := time.Unix(1000, 0)
+	// 4s of audio captured in two parts, 60s apart, in a window starting 10s before the audio
+	timeline := gst.NewTimeline(
+		gst.Chunk{Time: start, Data: make([]byte, 2*gst.SampleRate*gst.BytesPerSample)},
+		gst.Chunk{Time: start.Add(62 * time.Second), Data: make([]byte, 2*gst.SampleRate*gst.BytesPerSample)},
+	)
+	segments := []Segment{{StartMs: 500, EndMs: 3000, Text: "one two", Words: []Word{
+		{Word: "one", StartMs: 500, EndMs: 900},
+		{Word: "two", StartMs: 2500, EndMs: 3000},
+	}}}
+
+	retimed := conversationSegments("e1", segments, timeline, start.Add(-10*time.Second))
+	want := []Segment{{Endpoint: "e1", StartMs: 10500, EndMs: 73000, Text: "one two", Words: []Word{
+		{Word: "one", StartMs: 10500, EndMs: 10900},
+		{Word: "two", StartMs: 72500, EndMs: 73000},
+	}}}
+	if !reflect.DeepEqual(retimed, want) {
+		t.Errorf("segments %+v, want %+v", retimed, want)
+	}
+	if segments[0].Words[0].StartMs != 500 {
+		t.Error("recognized segments modified")
+	}
+}
+
+func TestCheckConversationWindow(t *testing.T) {
+	start := time.Unix(1000, 0)
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+	tests := []struct {
+		name     string
+		from, to time.Time
+		err      error
+	}{
+		{"inside", at(10), at(20), nil},
+		{"overlapping start", at(-10), at(20), nil},
+		{"overlapping end", at(290), at(310), nil},
+		{"from equals to", at(10), at(10), errEmptyWindow},
+		{"from after to", at(20), at(10), errEmptyWindow},
+		{"before retained audio", at(-20), at(0), errWindowNotRetained},
+		{"after retained audio", at(300), at(310), errWindowNotRetained},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &recognitionRequest{from: test.from, to: test.to}
+			if err := checkConversationWindow(request, at(0), at(300)); err != test.err {
+				t.Errorf("got %v, want %v", err, test.err)
+			}
+		})
+	}
+}
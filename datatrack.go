@@ -6,7 +6,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	gst "rtp-audio-processor/gstreamer-src"
 	"time"
 )
 
@@ -29,7 +28,7 @@ func datatrackHandler(_ context.Context, msg *pubsub.Message) {
 			msg.Nack()
 			return
 		}
-		if err := gst.UpdatePipeline(state.Sid, nil, state.Speakers); err != nil {
+		if err := updatePipeline(state.Sid, nil, state.Speakers); err != nil {
 			fmt.Printf("can not update pipeline, err = %v\n", err)
 		}
 	} else {
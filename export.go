@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	gst "rtp-audio-processor/gstreamer-src"
+	"strings"
+	"time"
+)
+
+// pipelineExportHandler serves a WAV mix of pipeline endpoints aligned by capture time.
+// Params: id or bookmarkId, endpoints (comma separated, all by default), from/to (unix ms, last 5 minutes
+// or the bookmark window by default), multichannel (one channel per endpoint in X-Endpoints header order).
+func pipelineExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	multichannel := false
+	if hasRequestParam(r, "multichannel") {
+		var err error
+		multichannel, err = getRequestParamBool(r, "multichannel")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var endpointIds []string
+	if hasRequestParam(r, "endpoints") {
+		endpoints, err := getRequestParam(r, "endpoints")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		endpointIds = strings.Split(endpoints, ",")
+	}
+
+	if hasRequestParam(r, "bookmarkId") {
+		bookmarkId, err := getRequestParam(r, "bookmarkId")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bookmark, err := gst.GetBookmark(bookmarkId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if endpointIds == nil {
+			endpointIds = bookmark.Endpoints
+		}
+
+		log.Printf("ExportBookmarkMix(bookmarkId=%s, endpoints=%v, multichannel=%v)\n", bookmarkId, endpointIds, multichannel)
+		mix, err := gst.ExportBookmarkMix(bookmarkId, endpointIds, multichannel)
+		writeMix(w, mix, endpointIds, err)
+		return
+	}
+
+	id, err := getRequestParam(r, "id")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if endpointIds == nil {
+		endpointIds, err = gst.PipelineEndpoints(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	to := time.Now()
+	if hasRequestParam(r, "to") {
+		to, err = getRequestParamTime(r, "to")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	from := to.Add(-gst.RingBufferDuration)
+	if hasRequestParam(r, "from") {
+		from, err = getRequestParamTime(r, "from")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("ExportMix(id=%s, endpoints=%v, from=%v, to=%v, multichannel=%v)\n", id, endpointIds, from, to, multichannel)
+	mix, err := gst.ExportMix(r.Context(), id, endpointIds, from, to, multichannel)
+	writeMix(w, mix, endpointIds, err)
+}
+
+func exportErrorCode(err error) int {
+	if _, ok := err.(*gst.NotFoundError); ok {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, gst.ErrBookmarkNotReady) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, gst.ErrTooManyBookmarks) {
+		return http.StatusTooManyRequests
+	}
+	if errors.Is(err, gst.ErrBookmarkMemoryFull) {
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+func writeMix(w http.ResponseWriter, mix *gst.MixReader, endpointIds []string, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), exportErrorCode(err))
+		return
+	}
+	defer mix.Close()
+
+	w.Header().Add("Content-Type", "audio/wav")
+	w.Header().Add("X-Endpoints", strings.Join(endpointIds, ","))
+	if err := writeWavHeader(w, mix.Channels(), gst.SampleRate, gst.BytesPerSample*8, mix.Size()); err != nil {
+		fmt.Printf("Can not write response: %v", err.Error())
+		return
+	}
+	if _, err := io.Copy(w, mix); err != nil {
+		fmt.Printf("Can not write response: %v", err.Error())
+	}
+}
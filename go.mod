@@ -3,9 +3,12 @@ module rtp-audio-processor
 go 1.16
 
 require (
-	cloud.google.com/go/pubsub v1.18.0 // indirect
+	cloud.google.com/go/pubsub v1.18.0
 	cloud.google.com/go/speech v1.2.0
 	cloud.google.com/go/storage v1.20.0
 	github.com/mccoyst/ogg v0.0.0-20160329013035-74f95136384d
+	github.com/minio/minio-go/v7 v7.0.23
 	google.golang.org/genproto v0.0.0-20220207164111-0872dc986b00
+	google.golang.org/grpc v1.44.0
+	google.golang.org/protobuf v1.27.1
 )
@@ -0,0 +1,298 @@
+package gstreamer_src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrBookmarkNotReady = errors.New("bookmark is not ready yet")
+var ErrTooManyBookmarks = errors.New("too many bookmarks, try again later")
+var ErrBookmarkMemoryFull = errors.New("bookmark memory is full, try again later")
+
+type BookmarkStatus string
+
+const (
+	BookmarkPending BookmarkStatus = "pending"
+	BookmarkReady   BookmarkStatus = "ready"
+	BookmarkFailed  BookmarkStatus = "failed"
+)
+
+// Bookmark is a window of pipeline audio frozen into clips, so it stays exportable after it left the ring buffers.
+type Bookmark struct {
+	Id         string
+	PipelineId string
+	Endpoints  []string
+	Time       time.Time
+	From       time.Time
+	To         time.Time
+	Status     BookmarkStatus
+	Error      string `json:",omitempty"`
+	clips      map[ /*endpointId*/ string][]Chunk
+	size       int64 // bytes of the clips, estimated from the window until they are captured
+}
+
+// bookmarkRetentionPeriod is how long captured clips are kept
+var bookmarkRetentionPeriod = time.Hour * 24
+
+// bookmarkMaxCount and bookmarkMaxBytes limit the bookmarks kept at once and the audio held by them,
+// set by BOOKMARK_MAX_COUNT (1000 by default) and BOOKMARK_MAX_BYTES (1 GiB by default)
+var bookmarkMaxCount = 1000
+var bookmarkMaxBytes int64 = 1 << 30
+
+var bookmarks map[string]*Bookmark
+var bookmarksSize int64
+var bookmarksMutex sync.Mutex
+
+func init() {
+	bookmarks = make(map[string]*Bookmark)
+
+	if period, isEnvSet := os.LookupEnv("BOOKMARK_RETENTION_PERIOD"); isEnvSet {
+		var err error
+		bookmarkRetentionPeriod, err = time.ParseDuration(period)
+		if err != nil {
+			panic(fmt.Sprintf("environment variable BOOKMARK_RETENTION_PERIOD is not a duration: %v", err))
+		}
+	}
+	if value, isEnvSet := os.LookupEnv("BOOKMARK_MAX_COUNT"); isEnvSet {
+		var err error
+		bookmarkMaxCount, err = strconv.Atoi(value)
+		if err != nil || bookmarkMaxCount <= 0 {
+			panic(fmt.Sprintf("environment variable BOOKMARK_MAX_COUNT is not a positive number: %v", value))
+		}
+	}
+	if value, isEnvSet := os.LookupEnv("BOOKMARK_MAX_BYTES"); isEnvSet {
+		var err error
+		bookmarkMaxBytes, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || bookmarkMaxBytes <= 0 {
+			panic(fmt.Sprintf("environment variable BOOKMARK_MAX_BYTES is not a positive number: %v", value))
+		}
+	}
+}
+
+func expireBookmarks() {
+	bookmarksMutex.Lock()
+	defer bookmarksMutex.Unlock()
+
+	for bookmarkId, bookmark := range bookmarks {
+		if time.Since(bookmark.To) > bookmarkRetentionPeriod {
+			bookmarksSize -= bookmark.size
+			delete(bookmarks, bookmarkId)
+		}
+	}
+}
+
+// CreateBookmark freezes [now-before, now+after) of the endpoints (all endpoints of the pipeline when empty)
+// once the after part has been recorded. It fails with ErrTooManyBookmarks or ErrBookmarkMemoryFull
+// when the bookmark would exceed bookmarkMaxCount or bookmarkMaxBytes.
+func CreateBookmark(pipelineId string, endpointIds []string, before, after time.Duration) (Bookmark, error) {
+	pipelineEndpointIds, err := PipelineEndpoints(pipelineId)
+	if err != nil {
+		return Bookmark{}, err
+	}
+	for _, endpointId := range endpointIds {
+		if i := sort.SearchStrings(pipelineEndpointIds, endpointId); i == len(pipelineEndpointIds) || pipelineEndpointIds[i] != endpointId {
+			return Bookmark{}, NewEndpointNotFoundError(endpointId)
+		}
+	}
+	endpoints := len(endpointIds)
+	if endpoints == 0 {
+		endpoints = len(pipelineEndpointIds)
+	}
+
+	now := time.Now()
+	bookmark := &Bookmark{
+		PipelineId: pipelineId,
+		Endpoints:  endpointIds,
+		Time:       now,
+		From:       now.Add(-before),
+		To:         now.Add(after),
+		Status:     BookmarkPending,
+		size:       int64(samplesBetween(now.Add(-before), now.Add(after))) * BytesPerSample * int64(endpoints),
+	}
+
+	bookmarksMutex.Lock()
+	if len(bookmarks) >= bookmarkMaxCount {
+		bookmarksMutex.Unlock()
+		return Bookmark{}, ErrTooManyBookmarks
+	}
+	if bookmarksSize+bookmark.size > bookmarkMaxBytes {
+		bookmarksMutex.Unlock()
+		return Bookmark{}, ErrBookmarkMemoryFull
+	}
+	bookmarksSize += bookmark.size
+	for {
+		bookmark.Id = strconv.FormatUint(rand.Uint64(), 10)
+		if _, ok := bookmarks[bookmark.Id]; !ok {
+			break
+		}
+	}
+	bookmarks[bookmark.Id] = bookmark
+	created := bookmark.copy()
+	bookmarksMutex.Unlock()
+
+	time.AfterFunc(after, func() {
+		captureBookmark(bookmark, endpointIds)
+	})
+	return created, nil
+}
+
+func captureBookmark(bookmark *Bookmark, endpointIds []string) {
+	var clips map[string][]Chunk
+	var err error
+	if len(endpointIds) == 0 {
+		endpointIds, err = PipelineEndpoints(bookmark.PipelineId)
+	}
+	if err == nil {
+		clips, err = captureClips(bookmark.PipelineId, endpointIds, bookmark.From, bookmark.To)
+	}
+
+	bookmarksMutex.Lock()
+	defer bookmarksMutex.Unlock()
+
+	// the estimate is replaced by the captured size, unless the bookmark expired meanwhile
+	var size int64
+	for _, clip := range clips {
+		for _, chunk := range clip {
+			size += int64(len(chunk.Data))
+		}
+	}
+	if _, ok := bookmarks[bookmark.Id]; ok {
+		bookmarksSize += size - bookmark.size
+	}
+	bookmark.size = size
+
+	if err != nil {
+		bookmark.Status = BookmarkFailed
+		bookmark.Error = err.Error()
+		fmt.Printf("bookmark %v capture failed: %v\n", bookmark.Id, err)
+		return
+	}
+	bookmark.Endpoints = endpointIds
+	bookmark.clips = clips
+	bookmark.Status = BookmarkReady
+}
+
+func captureClips(pipelineId string, endpointIds []string, from, to time.Time) (map[string][]Chunk, error) {
+	snapshots, err := snapshotRingBuffers(pipelineId, endpointIds)
+	if err != nil {
+		return nil, err
+	}
+
+	clips := make(map[string][]Chunk, len(endpointIds))
+	for i, snapshot := range snapshots {
+		export := startExport(context.Background(), snapshot)
+		var clip []Chunk
+		for {
+			chunk, err := export.next()
+			if err != nil {
+				break
+			}
+			if chunk = trimChunk(chunk, from, to); len(chunk.Data) > 0 {
+				clip = append(clip, chunk)
+			}
+		}
+		clips[endpointIds[i]] = clip
+	}
+	return clips, nil
+}
+
+func (b *Bookmark) copy() Bookmark {
+	bookmark := *b
+	bookmark.Endpoints = append([]string(nil), b.Endpoints...)
+	return bookmark
+}
+
+func GetBookmark(bookmarkId string) (Bookmark, error) {
+	bookmarksMutex.Lock()
+	defer bookmarksMutex.Unlock()
+
+	bookmark, ok := bookmarks[bookmarkId]
+	if !ok {
+		return Bookmark{}, NewBookmarkNotFoundError(bookmarkId)
+	}
+	return bookmark.copy(), nil
+}
+
+// ListBookmarks returns bookmarks of the pipeline (all bookmarks when pipelineId is empty) in creation order.
+func ListBookmarks(pipelineId string) []Bookmark {
+	bookmarksMutex.Lock()
+	defer bookmarksMutex.Unlock()
+
+	list := make([]Bookmark, 0)
+	for _, bookmark := range bookmarks {
+		if pipelineId == "" || bookmark.PipelineId == pipelineId {
+			list = append(list, bookmark.copy())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Time.Before(list[j].Time)
+	})
+	return list
+}
+
+func getBookmarkClips(bookmarkId string, endpointIds []string) ([]chunkIterator, error) {
+	bookmarksMutex.Lock()
+	defer bookmarksMutex.Unlock()
+
+	bookmark, ok := bookmarks[bookmarkId]
+	if !ok {
+		return nil, NewBookmarkNotFoundError(bookmarkId)
+	}
+	switch bookmark.Status {
+	case BookmarkPending:
+		return nil, ErrBookmarkNotReady
+	case BookmarkFailed:
+		return nil, errors.New(bookmark.Error)
+	}
+
+	sources := make([]chunkIterator, 0, len(endpointIds))
+	for _, endpointId := range endpointIds {
+		clip, ok := bookmark.clips[endpointId]
+		if !ok {
+			return nil, NewEndpointNotFoundError(endpointId)
+		}
+		sources = append(sources, &sliceChunkIterator{chunks: clip})
+	}
+	return sources, nil
+}
+
+func ExportBookmark(bookmarkId, endpointId string) (*ExportReader, error) {
+	sources, err := getBookmarkClips(bookmarkId, []string{endpointId})
+	if err != nil {
+		return nil, err
+	}
+	return &ExportReader{chunks: sources[0]}, nil
+}
+
+// ExportBookmarkWindow exports the endpoints of the bookmark over [from, to) of its window.
+func ExportBookmarkWindow(bookmarkId string, endpointIds []string, from, to time.Time) ([]*ExportReader, error) {
+	sources, err := getBookmarkClips(bookmarkId, endpointIds)
+	if err != nil {
+		return nil, err
+	}
+	readers := make([]*ExportReader, 0, len(sources))
+	for _, source := range sources {
+		readers = append(readers, &ExportReader{chunks: &windowChunkIterator{chunks: source, from: from, to: to}})
+	}
+	return readers, nil
+}
+
+// ExportBookmarkMix is ExportMix over the bookmark window.
+func ExportBookmarkMix(bookmarkId string, endpointIds []string, multichannel bool) (*MixReader, error) {
+	bookmark, err := GetBookmark(bookmarkId)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := getBookmarkClips(bookmarkId, endpointIds)
+	if err != nil {
+		return nil, err
+	}
+	return newMixReader(sources, bookmark.From, bookmark.To, multichannel), nil
+}
@@ -0,0 +1,189 @@
+package gstreamer_src
+
+// #include "gstreamer.h"
+import "C"
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// exportType receives chunks of a ring buffer snapshot from the C export
+type exportType struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	chunks chan Chunk
+}
+
+var exports map[uint64]*exportType
+var exportsMutex sync.Mutex
+
+func init() {
+	exports = make(map[uint64]*exportType)
+}
+
+// ExportReader streams S16LE mono audio of a ring buffer snapshot or a bookmark clip, so ingestion
+// is never blocked by a slow reader. Closing the reader (or cancelling its context) stops the export.
+type ExportReader struct {
+	chunks   chunkIterator
+	pending  []byte
+	timeline Timeline
+}
+
+func ExportPipeline(ctx context.Context, id, endpointId string) (*ExportReader, error) {
+	snapshots, err := snapshotRingBuffers(id, []string{endpointId})
+	if err != nil {
+		return nil, err
+	}
+	return startExport(ctx, snapshots[0]), nil
+}
+
+// ExportMix mixes the given endpoints of the pipeline over [from, to), aligning them by capture time.
+// With multichannel set every endpoint gets its own channel in endpointIds order instead.
+func ExportMix(ctx context.Context, id string, endpointIds []string, from, to time.Time, multichannel bool) (*MixReader, error) {
+	snapshots, err := snapshotRingBuffers(id, endpointIds)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := make([]chunkIterator, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		sources = append(sources, startExport(ctx, snapshot))
+	}
+	return newMixReader(sources, from, to, multichannel), nil
+}
+
+// ExportWindow exports the endpoints of the pipeline over [from, to), with ring buffers snapshotted at the same moment.
+func ExportWindow(ctx context.Context, id string, endpointIds []string, from, to time.Time) ([]*ExportReader, error) {
+	snapshots, err := snapshotRingBuffers(id, endpointIds)
+	if err != nil {
+		return nil, err
+	}
+
+	readers := make([]*ExportReader, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		export := startExport(ctx, snapshot)
+		readers = append(readers, &ExportReader{chunks: &windowChunkIterator{chunks: export.chunks, from: from, to: to}})
+	}
+	return readers, nil
+}
+
+func startExport(ctx context.Context, snapshot *C.RingBufferSnapshot) *ExportReader {
+	exportCtx, cancel := context.WithCancel(ctx)
+
+	exportsMutex.Lock()
+
+	var contextId uint64
+	for {
+		contextId = rand.Uint64()
+		if _, ok := exports[contextId]; !ok {
+			break
+		}
+	}
+
+	export := &exportType{
+		ctx:    exportCtx,
+		cancel: cancel,
+		chunks: make(chan Chunk, 16),
+	}
+
+	exports[contextId] = export
+
+	exportsMutex.Unlock()
+
+	go C.ringbuffer_export(snapshot, C.guint64(contextId))
+
+	fmt.Printf("%v export started\n", contextId)
+
+	return &ExportReader{chunks: export}
+}
+
+func (e *exportType) next() (Chunk, error) {
+	select {
+	case chunk, ok := <-e.chunks:
+		if !ok {
+			if err := e.ctx.Err(); err != nil {
+				return Chunk{}, err
+			}
+			return Chunk{}, io.EOF
+		}
+		return chunk, nil
+	case <-e.ctx.Done():
+		return Chunk{}, e.ctx.Err()
+	}
+}
+
+func (e *exportType) Close() error {
+	e.cancel()
+	return nil
+}
+
+func (r *ExportReader) next() (Chunk, error) {
+	chunk, err := r.chunks.next()
+	if err == nil {
+		r.timeline.add(chunk)
+	}
+	return chunk, err
+}
+
+// Timeline maps offsets into the audio read so far to capture times.
+func (r *ExportReader) Timeline() *Timeline {
+	return &r.timeline
+}
+
+func (r *ExportReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		chunk, err := r.next()
+		if err != nil {
+			return 0, err
+		}
+		r.pending = chunk.Data
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *ExportReader) Close() error {
+	if closer, ok := r.chunks.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+//export goHandleBuffer
+func goHandleBuffer(contextId C.guint64, captureTime C.guint64, buffer unsafe.Pointer, bufferLen C.int) C.gboolean {
+	exportsMutex.Lock()
+	export, ok := exports[uint64(contextId)]
+	exportsMutex.Unlock()
+	if !ok {
+		return C.FALSE
+	}
+
+	chunk := Chunk{
+		Time: time.Unix(0, int64(captureTime)),
+		Data: C.GoBytes(buffer, bufferLen),
+	}
+	select {
+	case export.chunks <- chunk:
+		return C.TRUE
+	case <-export.ctx.Done():
+		return C.FALSE
+	}
+}
+
+//export goHandleBufferEnd
+func goHandleBufferEnd(contextId C.guint64) {
+	exportsMutex.Lock()
+	defer exportsMutex.Unlock()
+
+	if export, ok := exports[uint64(contextId)]; ok {
+		close(export.chunks)
+		fmt.Printf("%v export finished\n", uint64(contextId))
+		delete(exports, uint64(contextId))
+	}
+}
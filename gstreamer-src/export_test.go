@@ -0,0 +1,88 @@
+package gstreamer_src
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+const frameSamples = SampleRate / 50 // 20ms
+
+func frame(i int) []byte {
+	data := make([]byte, frameSamples*BytesPerSample)
+	for pos := 0; pos < len(data); pos += BytesPerSample {
+		binary.LittleEndian.PutUint16(data[pos:], uint16(i))
+	}
+	return data
+}
+
+// checkFrames verifies that data is a gap-free sequence of frames ending with lastFrame.
+func checkFrames(t *testing.T, data []byte, lastFrame int) {
+	frameSize := frameSamples * BytesPerSample
+	if len(data)%frameSize != 0 {
+		t.Fatalf("export size %v is not a multiple of frame size", len(data))
+	}
+	frames := len(data) / frameSize
+	for i := 0; i < frames; i++ {
+		expected := uint16(lastFrame - frames + 1 + i)
+		for pos := i * frameSize; pos < (i+1)*frameSize; pos += BytesPerSample {
+			if sample := binary.LittleEndian.Uint16(data[pos:]); sample != expected {
+				t.Fatalf("frame %v: sample %v, expected %v", i, sample, expected)
+			}
+		}
+	}
+}
+
+func TestConcurrentExportDoesNotBlockIngestion(t *testing.T) {
+	ringBuffer := newRingBuffer()
+	defer unrefRingBuffer(ringBuffer)
+
+	start := time.Now()
+	addFrames := func(from, to int) {
+		for i := from; i < to; i++ {
+			ringBufferAdd(ringBuffer, frame(i), start.Add(time.Duration(i)*time.Second/50))
+		}
+	}
+	addFrames(0, 2000)
+
+	export := startExport(context.Background(), snapshotRingBuffer(ringBuffer))
+	defer export.Close()
+	first, err := export.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the export is stalled now; ingest more than the ring buffer holds, so its items get recycled
+	added := make(chan struct{})
+	go func() {
+		addFrames(2000, 20000)
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second * 10):
+		t.Fatal("ingestion is blocked by the export")
+	}
+
+	rest, err := io.ReadAll(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFrames(t, append(first.Data, rest...), 1999)
+	if size := len(first.Data) + len(rest); size != 2000*frameSamples*BytesPerSample {
+		t.Fatalf("snapshot export size %v, expected %v", size, 2000*frameSamples*BytesPerSample)
+	}
+
+	after := startExport(context.Background(), snapshotRingBuffer(ringBuffer))
+	defer after.Close()
+	data, err := io.ReadAll(after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFrames(t, data, 19999)
+	if duration := time.Duration(len(data)/BytesPerSample) * time.Second / SampleRate; duration < time.Minute*5 {
+		t.Fatalf("ring buffer holds %v, expected last 5 minutes", duration)
+	}
+}
@@ -24,7 +24,9 @@ typedef struct _PipelineData{
 typedef struct _RingBufferItem{
   gpointer content;
   gsize size;
+  GstClockTime time;
   GstClockTime duration;
+  gint refCount;
   struct _RingBufferItem * next;
   struct _RingBufferItem * prev;
 } RingBufferItem;
@@ -36,9 +38,25 @@ typedef struct _RingBuffer{
   RingBufferItem * lastItem;
   GstClockTime curDuration;
   GstClockTime maxDuration;
+  GstClockTime maxTimeDrift;
+  guint64 tapId;/* 0 when nobody listens to live audio */
+  gint refCount;
   GMutex lock;
 } RingBuffer;
 
+/* Items referenced by a snapshot are never recycled by the ring buffer, and the part of an item
+ * up to the snapshot size is never written again, so a snapshot can be exported without the lock */
+typedef struct _RingBufferSnapshotItem{
+  RingBufferItem * item;
+  gsize size;
+  GstClockTime time;
+} RingBufferSnapshotItem;
+
+typedef struct _RingBufferSnapshot{
+  RingBufferSnapshotItem * items;
+  guint count;
+} RingBufferSnapshot;
+
 static void pad_added_handler (GstElement *demux, guint ssrc, GstPad *pad, PipelineData *data);
 static void pad_removed_handler (GstElement *demux, guint ssrc, GstPad *pad, PipelineData *data);
 
@@ -245,15 +263,28 @@ static void pad_added_handler (GstElement *demux, guint ssrc, GstPad *ssrc_src_p
   gst_element_set_state (bin, GST_STATE_PLAYING);
 }
 
+RingBuffer* ringbuffer_new(void) {
+  RingBuffer * ringBuffer = calloc(1, sizeof(RingBuffer));
+  ringBuffer->maxDuration = GST_SECOND*60*5;//store only last 5 minutes
+  ringBuffer->itemContentCapacity = 48000*16/8;//buffer for 1 second 48khz S16LE mono
+  ringBuffer->maxTimeDrift = GST_MSECOND*200;//larger arrival jitter starts a new item
+  ringBuffer->refCount = 1;
+  g_mutex_init (&ringBuffer->lock);
+  return ringBuffer;
+}
+
+RingBuffer* ringbuffer_ref(RingBuffer * ringBuffer) {
+  g_atomic_int_inc(&ringBuffer->refCount);
+  return ringBuffer;
+}
+
 RingBuffer* linkAndUnrefAppSink(GstElement* appsink, RingBuffer* ringBuffer) {
   if (ringBuffer == NULL) {
-    ringBuffer = calloc(1, sizeof(RingBuffer));
-    ringBuffer->maxDuration = GST_SECOND*60*5;//store only last 5 minutes
-    ringBuffer->itemContentCapacity = 48000*16/8;//buffer for 1 second 48khz S16LE mono
-    g_mutex_init (&ringBuffer->lock);
+    ringBuffer = ringbuffer_new();
   }
   g_object_set(appsink, "emit-signals", TRUE, NULL);
-  g_signal_connect(appsink, "new-sample", G_CALLBACK(gstreamer_send_new_sample_handler), ringBuffer);
+  /* the appsink keeps the ring buffer alive until it is finalized */
+  g_signal_connect_data(appsink, "new-sample", G_CALLBACK(gstreamer_send_new_sample_handler), ringbuffer_ref(ringBuffer), (GClosureNotify)ringbuffer_unref, 0);
   gst_object_unref(appsink);
   g_print ("linkAndUnrefAppSink complete\n");
   return ringBuffer;
@@ -261,18 +292,40 @@ RingBuffer* linkAndUnrefAppSink(GstElement* appsink, RingBuffer* ringBuffer) {
 
 static void pad_removed_handler (GstElement *demux, guint ssrc, GstPad *ssrc_src_pad, PipelineData *data) {
   g_print ("%s. Received removed ssrc pad '%s' ssrc=%d from '%s':\n", GST_OBJECT_NAME(data->pipeline), GST_PAD_NAME (ssrc_src_pad), ssrc, GST_ELEMENT_NAME (demux));
+  goOnRemovedSsrc(GST_OBJECT_NAME(data->pipeline), ssrc);
 }
 
-static void ringbuffer_add(RingBuffer * ringBuffer, GstBuffer *gstBuf) {
+static RingBufferItem* ringbuffer_item_new(gsize capacity) {
+  RingBufferItem * item = calloc(1, sizeof(RingBufferItem));
+  item->content = malloc(capacity);
+  item->refCount = 1;
+  return item;
+}
+
+static void ringbuffer_item_unref(RingBufferItem * item) {
+  if (g_atomic_int_dec_and_test(&item->refCount)) {
+    free (item->content);
+    free (item);
+  }
+}
+
+void ringbuffer_add_data(RingBuffer * ringBuffer, gconstpointer data, gsize size, GstClockTime duration, GstClockTime time) {
   g_mutex_lock(&ringBuffer->lock);
 
-  gsize bufSize = gst_buffer_get_size(gstBuf);
+  gboolean contiguous = FALSE;
+  if (ringBuffer->lastItem != NULL) {
+    GstClockTime lastItemEnd = ringBuffer->lastItem->time + ringBuffer->lastItem->duration;
+    contiguous = ABS(GST_CLOCK_DIFF(lastItemEnd, time)) <= ringBuffer->maxTimeDrift;
+    if (contiguous) {
+      time = lastItemEnd;
+    }
+  }
 
-  if (ringBuffer->lastItem != NULL && (ringBuffer->lastItem->size+bufSize) <= ringBuffer->itemContentCapacity) {
-    gst_buffer_extract(gstBuf, 0, ringBuffer->lastItem->content + ringBuffer->lastItem->size, bufSize);
-    ringBuffer->lastItem->size += bufSize;
-    ringBuffer->lastItem->duration += GST_BUFFER_DURATION(gstBuf);
-    ringBuffer->curDuration += GST_BUFFER_DURATION(gstBuf);
+  if (contiguous && (ringBuffer->lastItem->size+size) <= ringBuffer->itemContentCapacity) {
+    memcpy(ringBuffer->lastItem->content + ringBuffer->lastItem->size, data, size);
+    ringBuffer->lastItem->size += size;
+    ringBuffer->lastItem->duration += duration;
+    ringBuffer->curDuration += duration;
   } else {
       RingBufferItem * newItem;
       if (ringBuffer->curDuration >= ringBuffer->maxDuration) {
@@ -282,15 +335,21 @@ static void ringbuffer_add(RingBuffer * ringBuffer, GstBuffer *gstBuf) {
         if (ringBuffer->firstItem != NULL) {
           ringBuffer->firstItem->prev = NULL;
         }
-        newItem = firstItem;
+        if (g_atomic_int_get(&firstItem->refCount) == 1) {
+          newItem = firstItem;
+        } else {
+          /* still referenced by a snapshot being exported */
+          ringbuffer_item_unref(firstItem);
+          newItem = ringbuffer_item_new(ringBuffer->itemContentCapacity);
+        }
       } else {
-        newItem = calloc(1, sizeof(RingBufferItem));
-        newItem->content = malloc(ringBuffer->itemContentCapacity);
+        newItem = ringbuffer_item_new(ringBuffer->itemContentCapacity);
       }
 
-      gst_buffer_extract(gstBuf, 0, newItem->content, bufSize);
-      newItem->size = bufSize;
-      newItem->duration = GST_BUFFER_DURATION(gstBuf);
+      memcpy(newItem->content, data, size);
+      newItem->size = size;
+      newItem->time = time;
+      newItem->duration = duration;
       newItem->prev = ringBuffer->lastItem;
       newItem->next = NULL;
       if (ringBuffer->lastItem != NULL) {
@@ -303,7 +362,31 @@ static void ringbuffer_add(RingBuffer * ringBuffer, GstBuffer *gstBuf) {
       ringBuffer->curDuration += newItem->duration;
   }
 
+  guint64 tapId = ringBuffer->tapId;
   g_mutex_unlock(&ringBuffer->lock);
+
+  if (tapId != 0) {
+    goHandleTap(tapId, time, (void *)data, size);
+  }
+}
+
+void ringbuffer_set_tap(RingBuffer * ringBuffer, guint64 tapId) {
+  g_mutex_lock(&ringBuffer->lock);
+  ringBuffer->tapId = tapId;
+  g_mutex_unlock(&ringBuffer->lock);
+}
+
+static void ringbuffer_add(RingBuffer * ringBuffer, GstBuffer *gstBuf) {
+  GstClockTime duration = GST_BUFFER_DURATION(gstBuf);
+  /* wall clock capture time of the buffer start, used to align endpoints on export */
+  GstClockTime time = g_get_real_time() * GST_USECOND - duration;
+
+  GstMapInfo map;
+  if (!gst_buffer_map(gstBuf, &map, GST_MAP_READ)) {
+    return;
+  }
+  ringbuffer_add_data(ringBuffer, map.data, map.size, duration, time);
+  gst_buffer_unmap(gstBuf, &map);
 }
 
 static GstFlowReturn gstreamer_send_new_sample_handler(GstElement *object, gpointer user_data) {
@@ -324,27 +407,63 @@ static GstFlowReturn gstreamer_send_new_sample_handler(GstElement *object, gpoin
   return GST_FLOW_OK;
 }
 
-void ringbuffer_export(RingBuffer * ringBuffer, guint64 contextId) {
+RingBufferSnapshot* ringbuffer_snapshot(RingBuffer * ringBuffer) {
   g_mutex_lock(&ringBuffer->lock);
 
-  RingBufferItem* item = ringBuffer->firstItem;
-  while(item != NULL) {
-    goHandleBuffer(contextId, item->content, item->size);
-    item = item->next;
+  RingBufferSnapshot * snapshot = calloc(1, sizeof(RingBufferSnapshot));
+  for (RingBufferItem* item = ringBuffer->firstItem; item != NULL; item = item->next) {
+    snapshot->count++;
+  }
+  snapshot->items = calloc(snapshot->count, sizeof(RingBufferSnapshotItem));
+
+  guint i = 0;
+  for (RingBufferItem* item = ringBuffer->firstItem; item != NULL; item = item->next, i++) {
+    g_atomic_int_inc(&item->refCount);
+    snapshot->items[i].item = item;
+    snapshot->items[i].size = item->size;
+    snapshot->items[i].time = item->time;
+  }
+
+  g_mutex_unlock(&ringBuffer->lock);
+  return snapshot;
+}
+
+void ringbuffer_export(RingBufferSnapshot * snapshot, guint64 contextId) {
+  guint i = 0;
+  while(i < snapshot->count && goHandleBuffer(contextId, snapshot->items[i].time, snapshot->items[i].item->content, snapshot->items[i].size)) {
+    i++;
   }
   goHandleBufferEnd(contextId);
 
+  ringbuffer_snapshot_free(snapshot);
+}
+
+void ringbuffer_snapshot_free(RingBufferSnapshot * snapshot) {
+  for (guint i = 0; i < snapshot->count; i++) {
+    ringbuffer_item_unref(snapshot->items[i].item);
+  }
+  free (snapshot->items);
+  free (snapshot);
+}
+
+GstClockTime ringbuffer_duration(RingBuffer * ringBuffer) {
+  g_mutex_lock(&ringBuffer->lock);
+  GstClockTime duration = ringBuffer->curDuration;
   g_mutex_unlock(&ringBuffer->lock);
+  return duration;
 }
 
-void ringbuffer_free (RingBuffer * ringBuffer) {
+void ringbuffer_unref (RingBuffer * ringBuffer) {
+  if (!g_atomic_int_dec_and_test(&ringBuffer->refCount)) {
+    return;
+  }
+
   g_mutex_lock (&ringBuffer->lock);
 
   RingBufferItem* item = ringBuffer->firstItem;
     while(item != NULL) {
-      free (item->content);
       RingBufferItem* nextItem = item->next;
-      free (item);
+      ringbuffer_item_unref (item);
       item = nextItem;
     }
 
@@ -358,3 +477,132 @@ void ringbuffer_free (RingBuffer * ringBuffer) {
 void setMuteProp(GstPad* audioMixerSinkPad, gboolean mute) {
   g_object_set (audioMixerSinkPad, "mute", mute, NULL);
 }
+
+gboolean element_available(gchar *name) {
+  GstElementFactory *factory = gst_element_factory_find(name);
+  if (factory == NULL) {
+    return FALSE;
+  }
+  gst_object_unref(factory);
+  return TRUE;
+}
+
+/* Transcoder runs audio pushed into its appsrc through a pipeline and hands what comes out of its appsink to Go */
+typedef struct _Transcoder{
+  GstElement *pipeline;
+  GstElement *appsrc;
+  guint64 id;
+} Transcoder;
+
+static GstFlowReturn transcoder_new_sample_handler(GstElement *appsink, gpointer user_data) {
+  Transcoder *transcoder = (Transcoder *)user_data;
+
+  GstSample *sample = NULL;
+  g_signal_emit_by_name (appsink, "pull-sample", &sample);
+  if (sample == NULL) {
+    return GST_FLOW_EOS;
+  }
+  GstFlowReturn ret = GST_FLOW_OK;
+  GstBuffer *buffer = gst_sample_get_buffer(sample);
+  GstMapInfo map;
+  if (buffer && gst_buffer_map(buffer, &map, GST_MAP_READ)) {
+    if (!goHandleTranscoded(transcoder->id, map.data, map.size)) {
+      ret = GST_FLOW_ERROR;
+    }
+    gst_buffer_unmap(buffer, &map);
+  }
+  gst_sample_unref(sample);
+  return ret;
+}
+
+/* Runs in the streaming thread which posts the message, so the transcoder does not depend on the main loop */
+static GstBusSyncReply transcoder_bus_handler(GstBus *bus, GstMessage *msg, gpointer user_data) {
+  Transcoder *transcoder = (Transcoder *)user_data;
+  GError *err;
+  gchar *debug_info;
+  switch (GST_MESSAGE_TYPE (msg)) {
+    case GST_MESSAGE_ERROR:
+      gst_message_parse_error (msg, &err, &debug_info);
+      goHandleTranscoderEnd(transcoder->id, err->message);
+      g_clear_error (&err);
+      g_free (debug_info);
+      break;
+    case GST_MESSAGE_EOS:
+      goHandleTranscoderEnd(transcoder->id, NULL);
+      break;
+    default:
+      break;
+  }
+  return GST_BUS_DROP;
+}
+
+Transcoder* transcoder_new(gchar *caps, gchar *description, guint64 transcoderId) {
+  gchar *launch = g_strdup_printf("appsrc name=src format=time block=true max-bytes=1048576 ! %s ! appsink name=sink sync=false emit-signals=true", description);
+  GError *error = NULL;
+  GstElement *pipeline = gst_parse_launch(launch, &error);
+  g_free(launch);
+  if (error != NULL) {
+    g_printerr ("Transcoder parse failed. Error: %s\n", error->message);
+    g_clear_error (&error);
+    if (pipeline != NULL) {
+      gst_object_unref (pipeline);
+    }
+    return NULL;
+  }
+  if (pipeline == NULL) {
+    return NULL;
+  }
+
+  Transcoder *transcoder = calloc(1, sizeof(Transcoder));
+  transcoder->pipeline = pipeline;
+  transcoder->id = transcoderId;
+  transcoder->appsrc = gst_bin_get_by_name(GST_BIN(pipeline), "src");
+  GstCaps *src_caps = gst_caps_from_string(caps);
+  g_object_set (transcoder->appsrc, "caps", src_caps, NULL);
+  gst_caps_unref (src_caps);
+
+  GstElement *appsink = gst_bin_get_by_name(GST_BIN(pipeline), "sink");
+  g_signal_connect (appsink, "new-sample", G_CALLBACK (transcoder_new_sample_handler), transcoder);
+  gst_object_unref (appsink);
+
+  GstBus *bus = gst_element_get_bus (pipeline);
+  gst_bus_set_sync_handler (bus, transcoder_bus_handler, transcoder, NULL);
+  gst_object_unref (bus);
+
+  if (gst_element_set_state (pipeline, GST_STATE_PLAYING) == GST_STATE_CHANGE_FAILURE) {
+    g_printerr ("Unable to set the transcoder to the playing state.\n");
+    transcoder_free (transcoder);
+    return NULL;
+  }
+  return transcoder;
+}
+
+/* Blocks while the appsrc queue is full, until transcoder_stop flushes it */
+GstFlowReturn transcoder_push(Transcoder *transcoder, gconstpointer data, gsize size, GstClockTime pts, GstClockTime duration) {
+  GstBuffer *buffer = gst_buffer_new_allocate(NULL, size, NULL);
+  gst_buffer_fill(buffer, 0, data, size);
+  GST_BUFFER_PTS(buffer) = pts;
+  GST_BUFFER_DURATION(buffer) = duration;
+
+  GstFlowReturn ret;
+  g_signal_emit_by_name (transcoder->appsrc, "push-buffer", buffer, &ret);
+  gst_buffer_unref (buffer);
+  return ret;
+}
+
+void transcoder_end(Transcoder *transcoder) {
+  GstFlowReturn ret;
+  g_signal_emit_by_name (transcoder->appsrc, "end-of-stream", &ret);
+}
+
+/* Must not be called from a streaming thread of the transcoder */
+void transcoder_stop(Transcoder *transcoder) {
+  gst_element_set_state (transcoder->pipeline, GST_STATE_NULL);
+}
+
+void transcoder_free(Transcoder *transcoder) {
+  gst_element_set_state (transcoder->pipeline, GST_STATE_NULL);
+  gst_object_unref (transcoder->appsrc);
+  gst_object_unref (transcoder->pipeline);
+  free (transcoder);
+}
@@ -4,11 +4,9 @@ package gstreamer_src
 // #include "gstreamer.h"
 import "C"
 import (
-	"bytes"
-	"context"
 	"fmt"
-	"math/rand"
 	"rtp-audio-processor/sets"
+	"sort"
 	"sync"
 	"time"
 	"unsafe"
@@ -30,9 +28,15 @@ func NewEndpointNotFoundError(endpoint string) *NotFoundError {
 	return &NotFoundError{Text: fmt.Sprintf("Endpoint(id=%v)", endpoint)}
 }
 
+func NewBookmarkNotFoundError(bookmarkId string) *NotFoundError {
+	return &NotFoundError{Text: fmt.Sprintf("Bookmark(id=%v)", bookmarkId)}
+}
+
 type knownEndpointInfo struct {
 	audioMixerSinkPad *C.GstPad
 	ringBuffer        *C.RingBuffer
+	ssrc              int
+	departedAt        time.Time
 }
 
 type unknownEndpointInfo struct {
@@ -41,6 +45,7 @@ type unknownEndpointInfo struct {
 }
 
 type pipelineType struct {
+	id                         string
 	videobridgeId              string
 	confGid                    string
 	pipeline                   *C.PipelineData
@@ -50,29 +55,23 @@ type pipelineType struct {
 	speakers                   sets.StringSet
 	endpointInfoMap            map[string]knownEndpointInfo
 	unknownSsrcEndpointInfoMap map[int]unknownEndpointInfo
+	deletedAt                  time.Time
 	lock                       sync.Mutex
 }
 
-type exportType struct {
-	buf  *bytes.Buffer
-	done chan struct{}
-}
-
 func (p *pipelineType) expired() bool {
 	return time.Since(p.touchTime).Minutes() > 1
 }
 
 var pipelines map[string]*pipelineType
 var pipelinesMutex sync.Mutex
-var exports map[uint64]exportType
-var exportsMutex sync.Mutex
 
 func init() {
-	exports = make(map[uint64]exportType)
 	pipelines = make(map[string]*pipelineType)
 	go func() {
 		for range time.Tick(time.Minute) {
 			expirePipelines()
+			expireBookmarks()
 		}
 	}()
 
@@ -86,10 +85,10 @@ func expirePipelines() {
 
 	for pipelineId, pipeline := range pipelines {
 		if pipeline.expired() {
-			C.gstreamer_delete_pipeline(pipeline.pipeline)
-			delete(pipelines, pipelineId)
+			retirePipeline(pipelineId, pipeline)
 		}
 	}
+	expireRetained()
 }
 
 func CreatePipeline(id, sinkHost string, sinkPort, seqNum int) (int, bool, error) {
@@ -110,6 +109,7 @@ func CreatePipeline(id, sinkHost string, sinkPort, seqNum int) (int, bool, error
 	var srcPort C.gint
 	pipeline := C.gstreamer_create_pipeline(idUnsafe, sinkHostUnsafe, C.gint(sinkPort), C.guint(seqNum), &srcPort)
 	pipelines[id] = &pipelineType{
+		id:                         id,
 		pipeline:                   pipeline,
 		srcPort:                    int(srcPort),
 		touchTime:                  time.Now(),
@@ -137,6 +137,7 @@ func UpdatePipeline(id string, ssrcEndpointMap map[int]string, speakers [] /*end
 				pipeline.endpointInfoMap[endpointId] = knownEndpointInfo{
 					audioMixerSinkPad: endpointInfo.audioMixerSinkPad,
 					ringBuffer:        C.linkAndUnrefAppSink(endpointInfo.appSink, nil),
+					ssrc:              ssrc,
 				}
 				delete(pipeline.unknownSsrcEndpointInfoMap, ssrc)
 			}
@@ -154,45 +155,73 @@ func UpdatePipeline(id string, ssrcEndpointMap map[int]string, speakers [] /*end
 	return nil
 }
 
-func ExportPipeline(ctx context.Context, id, endpointId string) (*bytes.Buffer, error) {
-	pipeline, ok := pipelines[id]
-	if !ok {
+// PipelineEndpoints lists endpoints of the pipeline, including the retained ones.
+func PipelineEndpoints(id string) ([]string, error) {
+	pipelinesMutex.Lock()
+	defer pipelinesMutex.Unlock()
+
+	candidates := findPipelines(id)
+	if len(candidates) == 0 {
 		return nil, NewPipelineNotFoundError(id)
 	}
-	endpointInfo, ok := pipeline.endpointInfoMap[endpointId]
-	if !ok {
-		return nil, NewEndpointNotFoundError(endpointId)
-	}
-
-	exportsMutex.Lock()
 
-	var contextId uint64
-	for {
-		contextId = rand.Uint64()
-		if _, ok := exports[contextId]; !ok {
-			break
+	endpointIds := sets.NewStringSet()
+	for _, pipeline := range candidates {
+		pipeline.lock.Lock()
+		for endpointId := range pipeline.endpointInfoMap {
+			endpointIds.Add(endpointId)
 		}
+		pipeline.lock.Unlock()
 	}
+	sortedEndpointIds := endpointIds.GetSlice()
+	sort.Strings(sortedEndpointIds)
+	return sortedEndpointIds, nil
+}
 
-	export := exportType{
-		buf:  bytes.NewBuffer(make([]byte, 0, 48000*16*60*5/8 /*buffer for 5 minutes 48khz S16LE */)),
-		done: make(chan struct{}),
+// findPipelines returns the live pipeline with the id followed by the retained one.
+// pipelinesMutex must be held.
+func findPipelines(id string) []*pipelineType {
+	candidates := make([]*pipelineType, 0, 2)
+	if pipeline, ok := pipelines[id]; ok {
+		candidates = append(candidates, pipeline)
 	}
+	if pipeline, ok := retainedPipelines[id]; ok {
+		candidates = append(candidates, pipeline)
+	}
+	return candidates
+}
 
-	exports[contextId] = export
-
-	exportsMutex.Unlock()
-
-	go C.ringbuffer_export(endpointInfo.ringBuffer, C.guint64(contextId))
+// snapshotRingBuffers takes snapshots of the endpoint ring buffers, looking into retained pipelines too.
+func snapshotRingBuffers(id string, endpointIds []string) ([]*C.RingBufferSnapshot, error) {
+	pipelinesMutex.Lock()
+	defer pipelinesMutex.Unlock()
 
-	fmt.Printf("%v export started\n", contextId)
+	candidates := findPipelines(id)
+	if len(candidates) == 0 {
+		return nil, NewPipelineNotFoundError(id)
+	}
 
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case <-export.done:
-		return export.buf, nil
+	snapshots := make([]*C.RingBufferSnapshot, 0, len(endpointIds))
+	for _, endpointId := range endpointIds {
+		var ringBuffer *C.RingBuffer
+		for _, pipeline := range candidates {
+			pipeline.lock.Lock()
+			endpointInfo, ok := pipeline.endpointInfoMap[endpointId]
+			pipeline.lock.Unlock()
+			if ok {
+				ringBuffer = endpointInfo.ringBuffer
+				break
+			}
+		}
+		if ringBuffer == nil {
+			for _, snapshot := range snapshots {
+				C.ringbuffer_snapshot_free(snapshot)
+			}
+			return nil, NewEndpointNotFoundError(endpointId)
+		}
+		snapshots = append(snapshots, C.ringbuffer_snapshot(ringBuffer))
 	}
+	return snapshots, nil
 }
 
 func DeletePipeline(id string) error {
@@ -203,43 +232,10 @@ func DeletePipeline(id string) error {
 	if !ok {
 		return NewPipelineNotFoundError(id)
 	}
-	for endpointId, endpointInfo := range pipeline.endpointInfoMap {
-		C.gst_object_unref(C.gpointer(endpointInfo.audioMixerSinkPad))
-		C.ringbuffer_free(endpointInfo.ringBuffer)
-		delete(pipeline.endpointInfoMap, endpointId)
-	}
-	for ssrc, endpointInfo := range pipeline.unknownSsrcEndpointInfoMap {
-		C.gst_object_unref(C.gpointer(endpointInfo.audioMixerSinkPad))
-		C.gst_object_unref(C.gpointer(endpointInfo.appSink))
-		delete(pipeline.unknownSsrcEndpointInfoMap, ssrc)
-	}
-	C.gstreamer_delete_pipeline(pipeline.pipeline)
-	delete(pipelines, id)
+	retirePipeline(id, pipeline)
 	return nil
 }
 
-//export goHandleBuffer
-func goHandleBuffer(contextId C.guint64, buffer unsafe.Pointer, bufferLen C.int) {
-	exportsMutex.Lock()
-	defer exportsMutex.Unlock()
-
-	if export, ok := exports[uint64(contextId)]; ok {
-		export.buf.Write(C.GoBytes(buffer, bufferLen))
-	}
-}
-
-//export goHandleBufferEnd
-func goHandleBufferEnd(contextId C.guint64) {
-	exportsMutex.Lock()
-	defer exportsMutex.Unlock()
-
-	if export, ok := exports[uint64(contextId)]; ok {
-		close(export.done)
-		fmt.Printf("%v export finished\n", uint64(contextId))
-		delete(exports, uint64(contextId))
-	}
-}
-
 //export goOnNewSsrc
 func goOnNewSsrc(pipelineId *C.gchar, ssrc C.guint, appsink *C.GstElement, audioMixerSinkPad *C.GstPad) {
 	if pipeline, ok := pipelines[C.GoString(pipelineId)]; ok {
@@ -259,6 +255,7 @@ func goOnNewSsrc(pipelineId *C.gchar, ssrc C.guint, appsink *C.GstElement, audio
 			pipeline.endpointInfoMap[endpointId] = knownEndpointInfo{
 				audioMixerSinkPad: audioMixerSinkPad,
 				ringBuffer:        ringBuffer,
+				ssrc:              int(ssrc),
 			}
 			if pipeline.speakers.Contains(endpointId) {
 				C.setMuteProp(audioMixerSinkPad, C.FALSE)
@@ -273,3 +270,18 @@ func goOnNewSsrc(pipelineId *C.gchar, ssrc C.guint, appsink *C.GstElement, audio
 		fmt.Printf("Unknown pipeline(id=%v)\n", C.GoString(pipelineId))
 	}
 }
+
+//export goOnRemovedSsrc
+func goOnRemovedSsrc(pipelineId *C.gchar, ssrc C.guint) {
+	if pipeline, ok := pipelines[C.GoString(pipelineId)]; ok {
+		pipeline.lock.Lock()
+		defer pipeline.lock.Unlock()
+
+		if endpointId, ok := pipeline.ssrcEndpointMap[int(ssrc)]; ok {
+			if endpointInfo, ok := pipeline.endpointInfoMap[endpointId]; ok && endpointInfo.ssrc == int(ssrc) {
+				endpointInfo.departedAt = time.Now()
+				pipeline.endpointInfoMap[endpointId] = endpointInfo
+			}
+		}
+	}
+}
@@ -5,23 +5,44 @@
 #include <gst/gst.h>
 #include <stdint.h>
 #include <stdlib.h>
+#include <string.h>
 
 typedef struct _RingBuffer RingBuffer;
+typedef struct _RingBufferSnapshot RingBufferSnapshot;
 typedef struct _PipelineData PipelineData;
+typedef struct _Transcoder Transcoder;
 
 extern void goOnNewSsrc(gchar *pipelineId, guint ssrc, GstElement* appsink, GstPad* audioMixerSinkPad);
-extern void goHandleBuffer(guint64 contextId, void *buffer, int bufferLen);
+extern void goOnRemovedSsrc(gchar *pipelineId, guint ssrc);
+extern gboolean goHandleBuffer(guint64 contextId, guint64 time, void *buffer, int bufferLen);
 extern void goHandleBufferEnd(guint64 contextId);
+extern void goHandleTap(guint64 tapId, guint64 time, void *buffer, int bufferLen);
+extern gboolean goHandleTranscoded(guint64 transcoderId, void *buffer, int bufferLen);
+extern void goHandleTranscoderEnd(guint64 transcoderId, gchar *error);
 
 void gstreamer_init(void);
 PipelineData* gstreamer_create_pipeline(gchar *id, gchar *sink_host, gint sink_port, guint seqnum, gint *src_port);
 void gstreamer_delete_pipeline(PipelineData *pipeline);
 void gstreamer_send_start_mainloop(void);
 
+RingBuffer* ringbuffer_new(void);
+RingBuffer* ringbuffer_ref(RingBuffer * ringBuffer);
 RingBuffer* linkAndUnrefAppSink(GstElement* appsink, RingBuffer* ringBuffer);
-void ringbuffer_export(RingBuffer * ringBuffer, guint64 contextId);
-void ringbuffer_free(RingBuffer * ringBuffer);
+void ringbuffer_add_data(RingBuffer * ringBuffer, gconstpointer data, gsize size, GstClockTime duration, GstClockTime time);
+void ringbuffer_set_tap(RingBuffer * ringBuffer, guint64 tapId);
+RingBufferSnapshot* ringbuffer_snapshot(RingBuffer * ringBuffer);
+void ringbuffer_export(RingBufferSnapshot * snapshot, guint64 contextId);
+void ringbuffer_snapshot_free(RingBufferSnapshot * snapshot);
+GstClockTime ringbuffer_duration(RingBuffer * ringBuffer);
+void ringbuffer_unref(RingBuffer * ringBuffer);
 
 void setMuteProp(GstPad* audioMixerSinkPad, gboolean mute);
 
+gboolean element_available(gchar *name);
+Transcoder* transcoder_new(gchar *caps, gchar *description, guint64 transcoderId);
+GstFlowReturn transcoder_push(Transcoder *transcoder, gconstpointer data, gsize size, GstClockTime pts, GstClockTime duration);
+void transcoder_end(Transcoder *transcoder);
+void transcoder_stop(Transcoder *transcoder);
+void transcoder_free(Transcoder *transcoder);
+
 #endif
\ No newline at end of file
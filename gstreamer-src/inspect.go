@@ -0,0 +1,98 @@
+package gstreamer_src
+
+// #include "gstreamer.h"
+import "C"
+import (
+	"sort"
+	"time"
+)
+
+type EndpointState struct {
+	Id              string
+	Ssrc            int
+	Speaker         bool
+	BufferedSeconds float64
+	DepartedAt      *time.Time `json:",omitempty"`
+	RetainedUntil   *time.Time `json:",omitempty"`
+}
+
+type PipelineState struct {
+	Id            string
+	SrcPort       int
+	TouchTime     time.Time
+	Speakers      []string
+	Endpoints     []EndpointState
+	UnknownSsrcs  []int
+	DeletedAt     *time.Time `json:",omitempty"`
+	RetainedUntil *time.Time `json:",omitempty"`
+}
+
+// InspectPipelines describes live and retained pipelines, all of them when id is empty.
+func InspectPipelines(id string) []PipelineState {
+	pipelinesMutex.Lock()
+	defer pipelinesMutex.Unlock()
+
+	var candidates []*pipelineType
+	if id != "" {
+		candidates = findPipelines(id)
+	} else {
+		for _, pipeline := range pipelines {
+			candidates = append(candidates, pipeline)
+		}
+		for _, pipeline := range retainedPipelines {
+			candidates = append(candidates, pipeline)
+		}
+	}
+
+	states := make([]PipelineState, 0, len(candidates))
+	for _, pipeline := range candidates {
+		states = append(states, pipeline.inspect())
+	}
+	sort.SliceStable(states, func(i, j int) bool {
+		return states[i].Id < states[j].Id
+	})
+	return states
+}
+
+func (p *pipelineType) inspect() PipelineState {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	state := PipelineState{
+		Id:           p.id,
+		SrcPort:      p.srcPort,
+		TouchTime:    p.touchTime,
+		Speakers:     p.speakers.GetSlice(),
+		Endpoints:    make([]EndpointState, 0, len(p.endpointInfoMap)),
+		UnknownSsrcs: make([]int, 0, len(p.unknownSsrcEndpointInfoMap)),
+	}
+	if !p.deletedAt.IsZero() {
+		deletedAt := p.deletedAt
+		retainedUntil := deletedAt.Add(retentionPeriod)
+		state.DeletedAt = &deletedAt
+		state.RetainedUntil = &retainedUntil
+	}
+	for endpointId, endpointInfo := range p.endpointInfoMap {
+		endpointState := EndpointState{
+			Id:              endpointId,
+			Ssrc:            endpointInfo.ssrc,
+			Speaker:         p.speakers.Contains(endpointId),
+			BufferedSeconds: time.Duration(C.ringbuffer_duration(endpointInfo.ringBuffer)).Seconds(),
+		}
+		if !endpointInfo.departedAt.IsZero() {
+			departedAt := endpointInfo.departedAt
+			retainedUntil := departedAt.Add(retentionPeriod)
+			endpointState.DepartedAt = &departedAt
+			endpointState.RetainedUntil = &retainedUntil
+		}
+		state.Endpoints = append(state.Endpoints, endpointState)
+	}
+	sort.Slice(state.Endpoints, func(i, j int) bool {
+		return state.Endpoints[i].Id < state.Endpoints[j].Id
+	})
+	for ssrc := range p.unknownSsrcEndpointInfoMap {
+		state.UnknownSsrcs = append(state.UnknownSsrcs, ssrc)
+	}
+	sort.Ints(state.UnknownSsrcs)
+	return state
+}
@@ -0,0 +1,201 @@
+package gstreamer_src
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	SampleRate     = 48000
+	BytesPerSample = 2 // S16LE
+	mixBlockLen    = SampleRate / 10
+
+	RingBufferDuration = time.Minute * 5
+)
+
+// Chunk is a piece of mono S16LE audio captured starting at Time.
+type Chunk struct {
+	Time time.Time
+	Data []byte
+}
+
+func (c Chunk) Duration() time.Duration {
+	return time.Duration(len(c.Data)/BytesPerSample) * time.Second / SampleRate
+}
+
+type chunkIterator interface {
+	// next returns io.EOF after the last chunk
+	next() (Chunk, error)
+}
+
+type sliceChunkIterator struct {
+	chunks []Chunk
+}
+
+func (it *sliceChunkIterator) next() (Chunk, error) {
+	if len(it.chunks) == 0 {
+		return Chunk{}, io.EOF
+	}
+	chunk := it.chunks[0]
+	it.chunks = it.chunks[1:]
+	return chunk, nil
+}
+
+func samplesBetween(from, to time.Time) int {
+	return int(to.Sub(from) * SampleRate / time.Second)
+}
+
+// trimChunk cuts the part of the chunk outside [from, to).
+func trimChunk(chunk Chunk, from, to time.Time) Chunk {
+	start := maxInt(0, samplesBetween(chunk.Time, from))
+	end := minInt(len(chunk.Data)/BytesPerSample, samplesBetween(chunk.Time, to))
+	if start >= end {
+		return Chunk{}
+	}
+	return Chunk{
+		Time: chunk.Time.Add(time.Duration(start) * time.Second / SampleRate),
+		Data: chunk.Data[start*BytesPerSample : end*BytesPerSample],
+	}
+}
+
+type mixTrack struct {
+	chunks chunkIterator
+	chunk  Chunk
+	start  int // sample position of chunk relative to the mix start
+	done   bool
+}
+
+// MixReader produces S16LE interleaved audio block by block, so the whole mix is never held in memory.
+type MixReader struct {
+	tracks   []*mixTrack
+	from     time.Time
+	channels int
+	samples  int // per channel
+	pos      int
+	acc      []int32
+	out      []byte
+	pending  []byte
+}
+
+func newMixReader(sources []chunkIterator, from, to time.Time, multichannel bool) *MixReader {
+	channels := 1
+	if multichannel {
+		channels = len(sources)
+	}
+	tracks := make([]*mixTrack, 0, len(sources))
+	for _, source := range sources {
+		tracks = append(tracks, &mixTrack{chunks: source})
+	}
+	samples := samplesBetween(from, to)
+	if samples < 0 {
+		samples = 0
+	}
+	return &MixReader{
+		tracks:   tracks,
+		from:     from,
+		channels: channels,
+		samples:  samples,
+		acc:      make([]int32, mixBlockLen*channels),
+		out:      make([]byte, mixBlockLen*channels*BytesPerSample),
+	}
+}
+
+// Close stops the exports feeding the mix.
+func (m *MixReader) Close() error {
+	for _, track := range m.tracks {
+		if closer, ok := track.chunks.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return nil
+}
+
+func (m *MixReader) Channels() int {
+	return m.channels
+}
+
+// Size is the total number of bytes the reader produces.
+func (m *MixReader) Size() int {
+	return m.samples * m.channels * BytesPerSample
+}
+
+func (m *MixReader) Read(p []byte) (int, error) {
+	for len(m.pending) == 0 {
+		if m.pos >= m.samples {
+			return 0, io.EOF
+		}
+		if err := m.mixBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, m.pending)
+	m.pending = m.pending[n:]
+	return n, nil
+}
+
+func (m *MixReader) mixBlock() error {
+	blockLen := mixBlockLen
+	if m.samples-m.pos < blockLen {
+		blockLen = m.samples - m.pos
+	}
+	acc := m.acc[:blockLen*m.channels]
+	for i := range acc {
+		acc[i] = 0
+	}
+
+	for i, track := range m.tracks {
+		channel := 0
+		if m.channels > 1 {
+			channel = i
+		}
+		if err := track.mixInto(acc, m.from, m.pos, blockLen, channel, m.channels); err != nil {
+			return err
+		}
+	}
+
+	out := m.out[:len(acc)*BytesPerSample]
+	for i, sample := range acc {
+		if sample > math.MaxInt16 {
+			sample = math.MaxInt16
+		} else if sample < math.MinInt16 {
+			sample = math.MinInt16
+		}
+		binary.LittleEndian.PutUint16(out[i*BytesPerSample:], uint16(int16(sample)))
+	}
+	m.pending = out
+	m.pos += blockLen
+	return nil
+}
+
+func (t *mixTrack) mixInto(acc []int32, from time.Time, blockStart, blockLen, channel, channels int) error {
+	blockEnd := blockStart + blockLen
+	for !t.done {
+		if t.chunk.Data == nil {
+			chunk, err := t.chunks.next()
+			if err == io.EOF {
+				t.done = true
+				return nil
+			} else if err != nil {
+				return err
+			}
+			t.chunk = chunk
+			t.start = samplesBetween(from, chunk.Time)
+		}
+
+		if t.start >= blockEnd {
+			return nil
+		}
+		chunkEnd := t.start + len(t.chunk.Data)/BytesPerSample
+		for pos := maxInt(blockStart, t.start); pos < minInt(blockEnd, chunkEnd); pos++ {
+			sample := int16(binary.LittleEndian.Uint16(t.chunk.Data[(pos-t.start)*BytesPerSample:]))
+			acc[(pos-blockStart)*channels+channel] += int32(sample)
+		}
+		if chunkEnd > blockEnd {
+			return nil
+		}
+		t.chunk = Chunk{}
+	}
+	return nil
+}
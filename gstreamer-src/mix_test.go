@@ -0,0 +1,157 @@
+package gstreamer_src
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+	"time"
+)
+
+// tone returns a chunk of d captured at t where every sample is level.
+func tone(t time.Time, d time.Duration, level int16) Chunk {
+	data := make([]byte, int(d*SampleRate/time.Second)*BytesPerSample)
+	for pos := 0; pos < len(data); pos += BytesPerSample {
+		binary.LittleEndian.PutUint16(data[pos:], uint16(level))
+	}
+	return Chunk{Time: t, Data: data}
+}
+
+// mixSpan is a level expected in a channel of the mix over [start, end) after the mix start.
+type mixSpan struct {
+	start, end time.Duration
+	channel    int
+	level      int32
+}
+
+func TestMixReader(t *testing.T) {
+	start := time.Unix(1000, 0)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	ms := time.Millisecond
+	tests := []struct {
+		name         string
+		tracks       [][]Chunk
+		from, to     time.Duration
+		multichannel bool
+		spans        []mixSpan
+	}{
+		{
+			name:   "contiguous chunks across blocks",
+			tracks: [][]Chunk{{tone(at(0), 150*ms, 100), tone(at(150*ms), 150*ms, 200)}},
+			to:     300 * ms,
+			spans:  []mixSpan{{0, 150 * ms, 0, 100}, {150 * ms, 300 * ms, 0, 200}},
+		},
+		{
+			name:   "gap is silence",
+			tracks: [][]Chunk{{tone(at(0), 100*ms, 100), tone(at(250*ms), 50*ms, 200)}},
+			to:     300 * ms,
+			spans:  []mixSpan{{0, 100 * ms, 0, 100}, {250 * ms, 300 * ms, 0, 200}},
+		},
+		{
+			name:   "late chunk is placed at its capture time",
+			tracks: [][]Chunk{{tone(at(0), 100*ms, 100), tone(at(103*ms), 100*ms, 200)}},
+			to:     203 * ms,
+			spans:  []mixSpan{{0, 100 * ms, 0, 100}, {103 * ms, 203 * ms, 0, 200}},
+		},
+		{
+			name:   "early chunk overlaps the previous one",
+			tracks: [][]Chunk{{tone(at(0), 100*ms, 100), tone(at(90*ms), 100*ms, 200)}},
+			to:     190 * ms,
+			spans:  []mixSpan{{0, 100 * ms, 0, 100}, {90 * ms, 190 * ms, 0, 200}},
+		},
+		{
+			name: "tracks are summed",
+			tracks: [][]Chunk{
+				{tone(at(0), 200*ms, 100)},
+				{tone(at(50*ms), 100*ms, -300)},
+			},
+			to:    200 * ms,
+			spans: []mixSpan{{0, 200 * ms, 0, 100}, {50 * ms, 150 * ms, 0, -300}},
+		},
+		{
+			name: "sum is clipped",
+			tracks: [][]Chunk{
+				{tone(at(0), 100*ms, 30000)},
+				{tone(at(0), 100*ms, 30000)},
+				{tone(at(100*ms), 100*ms, -30000)},
+				{tone(at(100*ms), 100*ms, -30000)},
+			},
+			to:    200 * ms,
+			spans: []mixSpan{{0, 100 * ms, 0, 60000}, {100 * ms, 200 * ms, 0, -60000}},
+		},
+		{
+			name: "multichannel interleaves tracks",
+			tracks: [][]Chunk{
+				{tone(at(0), 100*ms, 100)},
+				{tone(at(20*ms), 100*ms, 200)},
+				{},
+			},
+			to:           150 * ms,
+			multichannel: true,
+			spans:        []mixSpan{{0, 100 * ms, 0, 100}, {20 * ms, 120 * ms, 1, 200}},
+		},
+		{
+			name:   "chunks are clipped to from and to",
+			tracks: [][]Chunk{{tone(at(0), 100*ms, 100), tone(at(100*ms), 100*ms, 200), tone(at(200*ms), 100*ms, 300)}},
+			from:   50 * ms,
+			to:     220 * ms,
+			spans:  []mixSpan{{0, 50 * ms, 0, 100}, {50 * ms, 150 * ms, 0, 200}, {150 * ms, 170 * ms, 0, 300}},
+		},
+		{
+			name:   "window without audio",
+			tracks: [][]Chunk{{tone(at(0), 100*ms, 100)}},
+			from:   time.Second,
+			to:     time.Second + 100*ms,
+		},
+		{
+			name:   "empty window",
+			tracks: [][]Chunk{{tone(at(0), 100*ms, 100)}},
+			from:   100 * ms,
+			to:     50 * ms,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sources := make([]chunkIterator, 0, len(test.tracks))
+			for _, chunks := range test.tracks {
+				sources = append(sources, &sliceChunkIterator{chunks: chunks})
+			}
+			mix := newMixReader(sources, at(test.from), at(test.to), test.multichannel)
+			data, err := io.ReadAll(mix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != mix.Size() {
+				t.Fatalf("read %v bytes, Size %v", len(data), mix.Size())
+			}
+
+			channels := mix.Channels()
+			if test.multichannel && channels != len(test.tracks) {
+				t.Fatalf("%v channels, want %v", channels, len(test.tracks))
+			}
+			samples := 0
+			if test.to > test.from {
+				samples = samplesBetween(at(test.from), at(test.to))
+			}
+			want := make([]int32, samples*channels)
+			for _, span := range test.spans {
+				for pos := samplesBetween(start, at(span.start)); pos < samplesBetween(start, at(span.end)); pos++ {
+					want[pos*channels+span.channel] += span.level
+				}
+			}
+			if len(data) != len(want)*BytesPerSample {
+				t.Fatalf("read %v samples, want %v", len(data)/BytesPerSample, len(want))
+			}
+			for i, level := range want {
+				if level > math.MaxInt16 {
+					level = math.MaxInt16
+				} else if level < math.MinInt16 {
+					level = math.MinInt16
+				}
+				if got := int16(binary.LittleEndian.Uint16(data[i*BytesPerSample:])); int32(got) != level {
+					t.Fatalf("sample %v of channel %v is %v, want %v", i/channels, i%channels, got, level)
+				}
+			}
+		})
+	}
+}
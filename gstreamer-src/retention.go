@@ -0,0 +1,91 @@
+package gstreamer_src
+
+// #include "gstreamer.h"
+import "C"
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// retentionPeriod is how long ring buffers of departed endpoints and deleted pipelines stay exportable
+var retentionPeriod = time.Minute * 10
+var retainedPipelines map[string]*pipelineType
+
+func init() {
+	retainedPipelines = make(map[string]*pipelineType)
+
+	if period, isEnvSet := os.LookupEnv("RETENTION_PERIOD"); isEnvSet {
+		var err error
+		retentionPeriod, err = time.ParseDuration(period)
+		if err != nil {
+			panic(fmt.Sprintf("environment variable RETENTION_PERIOD is not a duration: %v", err))
+		}
+	}
+}
+
+// retirePipeline stops the pipeline and keeps its ring buffers read-only for the retention period.
+// pipelinesMutex must be held.
+func retirePipeline(id string, pipeline *pipelineType) {
+	pipeline.lock.Lock()
+	for endpointId, endpointInfo := range pipeline.endpointInfoMap {
+		C.gst_object_unref(C.gpointer(endpointInfo.audioMixerSinkPad))
+		endpointInfo.audioMixerSinkPad = nil
+		if retentionPeriod > 0 {
+			pipeline.endpointInfoMap[endpointId] = endpointInfo
+		} else {
+			C.ringbuffer_unref(endpointInfo.ringBuffer)
+			delete(pipeline.endpointInfoMap, endpointId)
+		}
+	}
+	for ssrc, endpointInfo := range pipeline.unknownSsrcEndpointInfoMap {
+		C.gst_object_unref(C.gpointer(endpointInfo.audioMixerSinkPad))
+		C.gst_object_unref(C.gpointer(endpointInfo.appSink))
+		delete(pipeline.unknownSsrcEndpointInfoMap, ssrc)
+	}
+	pipeline.deletedAt = time.Now()
+	pipeline.lock.Unlock()
+
+	// not under the pipeline lock, streaming threads may wait for it in goOnNewSsrc
+	C.gstreamer_delete_pipeline(pipeline.pipeline)
+	pipeline.pipeline = nil
+	delete(pipelines, id)
+
+	if len(pipeline.endpointInfoMap) > 0 {
+		if oldPipeline, ok := retainedPipelines[id]; ok {
+			freeRetainedEndpoints(oldPipeline, true)
+		}
+		retainedPipelines[id] = pipeline
+	}
+}
+
+// expireRetained frees ring buffers whose retention period is over.
+// pipelinesMutex must be held.
+func expireRetained() {
+	for pipelineId, pipeline := range retainedPipelines {
+		if time.Since(pipeline.deletedAt) > retentionPeriod {
+			freeRetainedEndpoints(pipeline, true)
+			delete(retainedPipelines, pipelineId)
+		}
+	}
+	for _, pipeline := range pipelines {
+		freeRetainedEndpoints(pipeline, false)
+	}
+}
+
+func freeRetainedEndpoints(pipeline *pipelineType, all bool) {
+	pipeline.lock.Lock()
+	defer pipeline.lock.Unlock()
+
+	for endpointId, endpointInfo := range pipeline.endpointInfoMap {
+		if !all && (endpointInfo.departedAt.IsZero() || time.Since(endpointInfo.departedAt) <= retentionPeriod) {
+			continue
+		}
+		if endpointInfo.audioMixerSinkPad != nil {
+			C.setMuteProp(endpointInfo.audioMixerSinkPad, C.TRUE)
+			C.gst_object_unref(C.gpointer(endpointInfo.audioMixerSinkPad))
+		}
+		C.ringbuffer_unref(endpointInfo.ringBuffer)
+		delete(pipeline.endpointInfoMap, endpointId)
+	}
+}
@@ -0,0 +1,27 @@
+package gstreamer_src
+
+// #include "gstreamer.h"
+import "C"
+import (
+	"time"
+	"unsafe"
+)
+
+// Wrappers to feed a ring buffer directly, without an appsink in front of it.
+
+func newRingBuffer() *C.RingBuffer {
+	return C.ringbuffer_new()
+}
+
+func ringBufferAdd(ringBuffer *C.RingBuffer, data []byte, captureTime time.Time) {
+	duration := time.Duration(len(data)/BytesPerSample) * time.Second / SampleRate
+	C.ringbuffer_add_data(ringBuffer, C.gconstpointer(unsafe.Pointer(&data[0])), C.gsize(len(data)), C.GstClockTime(duration), C.GstClockTime(captureTime.UnixNano()))
+}
+
+func snapshotRingBuffer(ringBuffer *C.RingBuffer) *C.RingBufferSnapshot {
+	return C.ringbuffer_snapshot(ringBuffer)
+}
+
+func unrefRingBuffer(ringBuffer *C.RingBuffer) {
+	C.ringbuffer_unref(ringBuffer)
+}
@@ -0,0 +1,118 @@
+package gstreamer_src
+
+// #include "gstreamer.h"
+import "C"
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// tapBufferDuration is how much live audio a tap holds for a slow reader before it drops chunks
+const tapBufferDuration = time.Second * 10
+
+var ErrEndpointTapped = errors.New("endpoint is already tapped")
+
+// Tap receives the audio of an endpoint as it is ingested, in the S16LE mono format of exports.
+// Chunks are dropped instead of blocking ingestion when the reader falls behind.
+type Tap struct {
+	// Chunks is closed by Close
+	Chunks     <-chan Chunk
+	chunks     chan Chunk
+	id         uint64
+	ringBuffer *C.RingBuffer
+	dropped    int
+}
+
+var taps map[uint64]*Tap
+var tapsMutex sync.Mutex
+
+func init() {
+	taps = make(map[uint64]*Tap)
+}
+
+// TapEndpoint starts streaming live audio of an endpoint of a running pipeline. An endpoint has one tap at most.
+func TapEndpoint(pipelineId, endpointId string) (*Tap, error) {
+	pipelinesMutex.Lock()
+	defer pipelinesMutex.Unlock()
+
+	pipeline, ok := pipelines[pipelineId]
+	if !ok {
+		return nil, NewPipelineNotFoundError(pipelineId)
+	}
+	pipeline.lock.Lock()
+	endpointInfo, ok := pipeline.endpointInfoMap[endpointId]
+	pipeline.lock.Unlock()
+	if !ok {
+		return nil, NewEndpointNotFoundError(endpointId)
+	}
+
+	tapsMutex.Lock()
+	defer tapsMutex.Unlock()
+
+	for _, tap := range taps {
+		if tap.ringBuffer == endpointInfo.ringBuffer {
+			return nil, ErrEndpointTapped
+		}
+	}
+
+	// appsink buffers are 20ms or longer
+	chunks := make(chan Chunk, int(tapBufferDuration/(time.Millisecond*20)))
+	tap := &Tap{
+		Chunks:     chunks,
+		chunks:     chunks,
+		ringBuffer: C.ringbuffer_ref(endpointInfo.ringBuffer),
+	}
+	for {
+		tap.id = rand.Uint64()
+		if _, ok := taps[tap.id]; !ok && tap.id != 0 {
+			break
+		}
+	}
+	taps[tap.id] = tap
+	C.ringbuffer_set_tap(tap.ringBuffer, C.guint64(tap.id))
+	return tap, nil
+}
+
+// Close stops the tap and closes its Chunks channel.
+func (t *Tap) Close() {
+	C.ringbuffer_set_tap(t.ringBuffer, 0)
+
+	tapsMutex.Lock()
+	_, ok := taps[t.id]
+	if ok {
+		delete(taps, t.id)
+		close(t.chunks)
+		if t.dropped > 0 {
+			fmt.Printf("tap %v dropped %v chunks\n", t.id, t.dropped)
+		}
+	}
+	tapsMutex.Unlock()
+
+	if ok {
+		C.ringbuffer_unref(t.ringBuffer)
+	}
+}
+
+//export goHandleTap
+func goHandleTap(tapId C.guint64, captureTime C.guint64, buffer unsafe.Pointer, bufferLen C.int) {
+	tapsMutex.Lock()
+	defer tapsMutex.Unlock()
+
+	tap, ok := taps[uint64(tapId)]
+	if !ok {
+		return
+	}
+	chunk := Chunk{
+		Time: time.Unix(0, int64(captureTime)),
+		Data: C.GoBytes(buffer, bufferLen),
+	}
+	select {
+	case tap.chunks <- chunk:
+	default:
+		tap.dropped++
+	}
+}
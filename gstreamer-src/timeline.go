@@ -0,0 +1,89 @@
+package gstreamer_src
+
+import (
+	"io"
+	"sort"
+	"time"
+)
+
+// timelineTolerance is how far a chunk may be off the end of the previous one and still count as contiguous
+const timelineTolerance = time.Millisecond * 5
+
+// Timeline maps offsets into exported audio back to capture times, as the export skips gaps in the audio.
+type Timeline struct {
+	segments []timelineSegment
+	duration time.Duration
+}
+
+type timelineSegment struct {
+	offset time.Duration
+	time   time.Time
+}
+
+// NewTimeline returns the timeline of audio exported from the chunks.
+func NewTimeline(chunks ...Chunk) *Timeline {
+	timeline := &Timeline{}
+	for _, chunk := range chunks {
+		timeline.add(chunk)
+	}
+	return timeline
+}
+
+// add appends a chunk which starts at the current end of the exported audio.
+func (t *Timeline) add(chunk Chunk) {
+	if len(t.segments) > 0 {
+		last := t.segments[len(t.segments)-1]
+		drift := chunk.Time.Sub(last.time.Add(t.duration - last.offset))
+		if drift > -timelineTolerance && drift < timelineTolerance {
+			t.duration += chunk.Duration()
+			return
+		}
+	}
+	t.segments = append(t.segments, timelineSegment{offset: t.duration, time: chunk.Time})
+	t.duration += chunk.Duration()
+}
+
+// CaptureTime returns when the audio at offset into the export was captured.
+func (t *Timeline) CaptureTime(offset time.Duration) time.Time {
+	if len(t.segments) == 0 {
+		return time.Time{}
+	}
+	i := sort.Search(len(t.segments), func(i int) bool {
+		return t.segments[i].offset > offset
+	})
+	segment := t.segments[maxInt(0, i-1)]
+	return segment.time.Add(offset - segment.offset)
+}
+
+// Duration is the length of the exported audio.
+func (t *Timeline) Duration() time.Duration {
+	return t.duration
+}
+
+// windowChunkIterator trims chunks to [from, to).
+type windowChunkIterator struct {
+	chunks   chunkIterator
+	from, to time.Time
+}
+
+func (it *windowChunkIterator) next() (Chunk, error) {
+	for {
+		chunk, err := it.chunks.next()
+		if err != nil {
+			return Chunk{}, err
+		}
+		if !chunk.Time.Before(it.to) {
+			return Chunk{}, io.EOF
+		}
+		if chunk = trimChunk(chunk, it.from, it.to); len(chunk.Data) > 0 {
+			return chunk, nil
+		}
+	}
+}
+
+func (it *windowChunkIterator) Close() error {
+	if closer, ok := it.chunks.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package gstreamer_src
+
+import (
+	"testing"
+	"time"
+)
+
+// silence returns a chunk of d captured at t.
+func silence(t time.Time, d time.Duration) Chunk {
+	return Chunk{Time: t, Data: make([]byte, int(d*SampleRate/time.Second)*BytesPerSample)}
+}
+
+func TestTimelineCaptureTime(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		name     string
+		chunks   []Chunk
+		duration time.Duration
+		offsets  map[time.Duration]time.Time
+	}{
+		{
+			name:     "contiguous",
+			chunks:   []Chunk{silence(start, time.Second), silence(start.Add(time.Second), time.Second)},
+			duration: 2 * time.Second,
+			offsets: map[time.Duration]time.Time{
+				0:                       start,
+				time.Millisecond * 1500: start.Add(time.Millisecond * 1500),
+				2 * time.Second:         start.Add(2 * time.Second),
+			},
+		},
+		{
+			name:     "gap",
+			chunks:   []Chunk{silence(start, time.Second), silence(start.Add(10*time.Second), time.Second)},
+			duration: 2 * time.Second,
+			offsets: map[time.Duration]time.Time{
+				time.Millisecond * 999:  start.Add(time.Millisecond * 999),
+				time.Second:             start.Add(10 * time.Second),
+				time.Millisecond * 1250: start.Add(time.Millisecond * 10250),
+			},
+		},
+		{
+			name: "jitter within tolerance",
+			chunks: []Chunk{silence(start, time.Second),
+				silence(start.Add(time.Second+3*time.Millisecond), time.Second)},
+			duration: 2 * time.Second,
+			offsets: map[time.Duration]time.Time{
+				time.Millisecond * 1500: start.Add(time.Millisecond * 1500),
+			},
+		},
+		{
+			name: "drift beyond tolerance",
+			chunks: []Chunk{silence(start, time.Second),
+				silence(start.Add(time.Second+20*time.Millisecond), time.Second)},
+			duration: 2 * time.Second,
+			offsets: map[time.Duration]time.Time{
+				time.Millisecond * 1500: start.Add(time.Millisecond * 1520),
+			},
+		},
+		{
+			name:   "gap and overlap",
+			chunks: []Chunk{silence(start, time.Second), silence(start.Add(5*time.Second), time.Second), silence(start.Add(5500*time.Millisecond), time.Second)},
+			offsets: map[time.Duration]time.Time{
+				time.Millisecond * 500:  start.Add(time.Millisecond * 500),
+				time.Millisecond * 1500: start.Add(time.Millisecond * 5500),
+				time.Millisecond * 2500: start.Add(time.Millisecond * 6000),
+			},
+			duration: 3 * time.Second,
+		},
+		{
+			name:     "empty",
+			duration: 0,
+			offsets:  map[time.Duration]time.Time{time.Second: {}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			timeline := NewTimeline(test.chunks...)
+			if timeline.Duration() != test.duration {
+				t.Errorf("duration %v, want %v", timeline.Duration(), test.duration)
+			}
+			for offset, want := range test.offsets {
+				if got := timeline.CaptureTime(offset); !got.Equal(want) {
+					t.Errorf("CaptureTime(%v) = %v, want %v", offset, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package gstreamer_src
+
+// #include "gstreamer.h"
+import "C"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// exportCaps are the caps of exported audio
+const exportCaps = "audio/x-raw,format=S16LE,layout=interleaved,rate=48000,channels=1"
+
+// Transcoder runs the audio written to it through a GStreamer pipeline, e.g. a resampler and an encoder,
+// writing what comes out of the pipeline to w. Close ends the audio and waits for the rest of the output.
+type Transcoder struct {
+	id             uint64
+	transcoder     *C.Transcoder
+	w              io.Writer
+	bytesPerSecond int64
+	written        int64
+	// ended is closed by the end of stream or the first error of the pipeline or w, stopped once the
+	// pipeline is stopped after it, which unblocks a pending Write
+	ended   chan struct{}
+	stopped chan struct{}
+	err     error
+	lock    sync.Mutex
+}
+
+var transcoders map[uint64]*Transcoder
+var transcodersMutex sync.Mutex
+
+func init() {
+	transcoders = make(map[uint64]*Transcoder)
+}
+
+// NewEncoder transcodes exported audio by description, which is a gst-launch pipeline description such as
+// "audioresample ! audio/x-raw,rate=16000 ! flacenc".
+func NewEncoder(w io.Writer, description string) (*Transcoder, error) {
+	return newTranscoder(w, exportCaps, description, SampleRate*BytesPerSample)
+}
+
+// newTranscoder transcodes audio in caps by description. Raw audio is timestamped by its bytesPerSecond,
+// other audio is not timestamped when it is 0.
+func newTranscoder(w io.Writer, caps, description string, bytesPerSecond int) (*Transcoder, error) {
+	t := &Transcoder{
+		w:              w,
+		bytesPerSecond: int64(bytesPerSecond),
+		ended:          make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+
+	transcodersMutex.Lock()
+	for {
+		t.id = rand.Uint64()
+		if _, ok := transcoders[t.id]; !ok {
+			break
+		}
+	}
+	transcoders[t.id] = t
+	transcodersMutex.Unlock()
+
+	capsUnsafe := C.CString(caps)
+	defer C.free(unsafe.Pointer(capsUnsafe))
+	descriptionUnsafe := C.CString(description)
+	defer C.free(unsafe.Pointer(descriptionUnsafe))
+	t.transcoder = C.transcoder_new(capsUnsafe, descriptionUnsafe, C.guint64(t.id))
+	if t.transcoder == nil {
+		t.forget()
+		return nil, fmt.Errorf("can not start transcoder %v", description)
+	}
+
+	go func() {
+		<-t.ended
+		C.transcoder_stop(t.transcoder)
+		close(t.stopped)
+	}()
+	return t, nil
+}
+
+func (t *Transcoder) Write(p []byte) (int, error) {
+	select {
+	case <-t.ended:
+		return 0, t.error()
+	default:
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	pts, duration := C.GstClockTime(C.GST_CLOCK_TIME_NONE), C.GstClockTime(C.GST_CLOCK_TIME_NONE)
+	if t.bytesPerSecond > 0 {
+		pts = C.GstClockTime(time.Duration(t.written) * time.Second / time.Duration(t.bytesPerSecond))
+		duration = C.GstClockTime(time.Duration(len(p)) * time.Second / time.Duration(t.bytesPerSecond))
+	}
+	if ret := C.transcoder_push(t.transcoder, C.gconstpointer(unsafe.Pointer(&p[0])), C.gsize(len(p)), pts, duration); ret != C.GST_FLOW_OK {
+		// the pipeline failed or was stopped by a failed write to w
+		<-t.stopped
+		if err := t.error(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("transcoder push error %v", int(ret))
+	}
+	t.written += int64(len(p))
+	return len(p), nil
+}
+
+// Close ends the audio, waits until the pipeline has written all of its output and frees it.
+func (t *Transcoder) Close() error {
+	C.transcoder_end(t.transcoder)
+	<-t.stopped
+	t.forget()
+	C.transcoder_free(t.transcoder)
+	return t.error()
+}
+
+func (t *Transcoder) error() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.err
+}
+
+// end records the first error, nil for the end of stream, and starts stopping the pipeline.
+func (t *Transcoder) end(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	select {
+	case <-t.ended:
+		return
+	default:
+	}
+	t.err = err
+	close(t.ended)
+}
+
+func (t *Transcoder) forget() {
+	transcodersMutex.Lock()
+	delete(transcoders, t.id)
+	transcodersMutex.Unlock()
+}
+
+func getTranscoder(transcoderId C.guint64) (*Transcoder, bool) {
+	transcodersMutex.Lock()
+	defer transcodersMutex.Unlock()
+
+	t, ok := transcoders[uint64(transcoderId)]
+	return t, ok
+}
+
+//export goHandleTranscoded
+func goHandleTranscoded(transcoderId C.guint64, buffer unsafe.Pointer, bufferLen C.int) C.gboolean {
+	t, ok := getTranscoder(transcoderId)
+	if !ok {
+		return C.FALSE
+	}
+	if _, err := t.w.Write(C.GoBytes(buffer, bufferLen)); err != nil {
+		t.end(err)
+		return C.FALSE
+	}
+	return C.TRUE
+}
+
+//export goHandleTranscoderEnd
+func goHandleTranscoderEnd(transcoderId C.guint64, message *C.gchar) {
+	t, ok := getTranscoder(transcoderId)
+	if !ok {
+		return
+	}
+	if message != nil {
+		t.end(errors.New(C.GoString(message)))
+	} else {
+		t.end(nil)
+	}
+}
+
+// elementsAvailable tells whether GStreamer has all the named elements.
+func elementsAvailable(names ...string) bool {
+	for _, name := range names {
+		nameUnsafe := C.CString(name)
+		available := C.element_available(nameUnsafe)
+		C.free(unsafe.Pointer(nameUnsafe))
+		if available == C.FALSE {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package gstreamer_src
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+)
+
+// sine returns seconds of a tone of frequency Hz as exported audio.
+func sine(seconds float64, frequency float64) []byte {
+	samples := int(seconds * SampleRate)
+	pcm := make([]byte, samples*BytesPerSample)
+	for i := 0; i < samples; i++ {
+		value := 10000 * math.Sin(2*math.Pi*frequency*float64(i)/SampleRate)
+		binary.LittleEndian.PutUint16(pcm[i*BytesPerSample:], uint16(int16(value)))
+	}
+	return pcm
+}
+
+func transcode(t *testing.T, pcm []byte, caps, description string, bytesPerSecond int) []byte {
+	var out bytes.Buffer
+	transcoder, err := newTranscoder(&out, caps, description, bytesPerSecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// in parts, like the uploads
+	for len(pcm) > 0 {
+		n := 32 * 1024
+		if n > len(pcm) {
+			n = len(pcm)
+		}
+		if _, err := transcoder.Write(pcm[:n]); err != nil {
+			t.Fatal(err)
+		}
+		pcm = pcm[n:]
+	}
+	if err := transcoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// decodeFlac decodes with libFLAC, as flacdec, back to exported audio.
+func decodeFlac(t *testing.T, flac []byte) []byte {
+	return transcode(t, flac, "audio/x-flac", "flacparse ! flacdec ! audioconvert ! audioresample ! "+exportCaps, 0)
+}
+
+func requireElements(t *testing.T, names ...string) {
+	t.Helper()
+	if !elementsAvailable(names...) {
+		t.Skipf("GStreamer elements %v are not available", names)
+	}
+}
+
+func TestFlacEncoderIsLossless(t *testing.T) {
+	requireElements(t, "appsrc", "appsink", "flacenc", "flacparse", "flacdec", "audioconvert", "audioresample")
+
+	pcm := sine(2.5, 440)
+	var encoded bytes.Buffer
+	encoder, err := NewEncoder(&encoded, "flacenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encoder.Write(pcm); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(encoded.Bytes(), []byte("fLaC")) {
+		t.Fatalf("no fLaC marker in %v bytes", encoded.Len())
+	}
+	if encoded.Len() >= len(pcm) {
+		t.Errorf("encoded %v bytes of %v", encoded.Len(), len(pcm))
+	}
+	if decoded := decodeFlac(t, encoded.Bytes()); !bytes.Equal(decoded, pcm) {
+		t.Errorf("decoded %v bytes differ from the %v encoded", len(decoded), len(pcm))
+	}
+}
+
+func TestFlacEncoderResamples(t *testing.T) {
+	requireElements(t, "appsrc", "appsink", "flacenc", "flacparse", "flacdec", "audioconvert", "audioresample")
+
+	pcm := sine(2, 300)
+	encoded := transcode(t, pcm, exportCaps, "audioresample ! audio/x-raw,rate=16000 ! flacenc", SampleRate*BytesPerSample)
+	decoded := decodeFlac(t, encoded)
+	if len(decoded) < len(pcm)*99/100 || len(decoded) > len(pcm)*101/100 {
+		t.Fatalf("decoded %v bytes of %v", len(decoded), len(pcm))
+	}
+
+	// the tone is below 8kHz, so it survives resampling up to a small error, after the latency of the resamplers
+	samples := func(pcm []byte, i int) float64 {
+		return float64(int16(binary.LittleEndian.Uint16(pcm[i*BytesPerSample:])))
+	}
+	best := math.Inf(1)
+	for lag := -100; lag <= 100; lag++ {
+		var diff, power float64
+		for i := SampleRate / 10; i < len(pcm)/BytesPerSample-SampleRate/10; i++ {
+			if j := i + lag; j >= 0 && j < len(decoded)/BytesPerSample {
+				d := samples(decoded, j) - samples(pcm, i)
+				diff += d * d
+				power += samples(pcm, i) * samples(pcm, i)
+			}
+		}
+		best = math.Min(best, diff/power)
+	}
+	if best > 0.001 {
+		t.Errorf("relative error power %v after resampling", best)
+	}
+}
+
+func TestTranscoderWriteError(t *testing.T) {
+	requireElements(t, "appsrc", "appsink", "flacenc")
+
+	failure := errors.New("storage failed")
+	transcoder, err := NewEncoder(failingWriter{failure}, "flacenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcm := sine(1, 440)
+	for i := 0; i < 20 && err == nil; i++ {
+		_, err = transcoder.Write(pcm)
+	}
+	if closeErr := transcoder.Close(); err == nil {
+		err = closeErr
+	}
+	if !errors.Is(err, failure) {
+		t.Errorf("error %v, want %v", err, failure)
+	}
+}
+
+type failingWriter struct {
+	err error
+}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
@@ -1,4 +1,5 @@
 package gstreamer_src
+
 import "C"
 
 func boolToInt(v bool) int {
@@ -7,4 +8,18 @@ func boolToInt(v bool) int {
 	} else {
 		return 0
 	}
-}
\ No newline at end of file
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
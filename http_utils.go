@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 func getRequestParam(r *http.Request, paramName string) (string, error) {
@@ -37,4 +39,60 @@ func getRequestParamUint64(r *http.Request, paramName string) (uint64, error) {
 		return 0, errors.New(fmt.Sprintf("%s param is not uint64", paramName))
 	}
 	return paramInt, nil
-}
\ No newline at end of file
+}
+
+func hasRequestParam(r *http.Request, paramName string) bool {
+	_, ok := r.URL.Query()[paramName]
+	return ok
+}
+
+func getRequestParamBool(r *http.Request, paramName string) (bool, error) {
+	param, err := getRequestParam(r, paramName)
+	if err != nil {
+		return false, err
+	}
+	paramBool, err := strconv.ParseBool(param)
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("%s param is not bool", paramName))
+	}
+	return paramBool, nil
+}
+
+// getRequestParamTime parses a unix timestamp in milliseconds
+func getRequestParamTime(r *http.Request, paramName string) (time.Time, error) {
+	paramInt, err := getRequestParamUint64(r, paramName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(paramInt)*int64(time.Millisecond)), nil
+}
+
+// getRequestParamDuration parses a Go duration such as 30s, or a number of seconds
+func getRequestParamDuration(r *http.Request, paramName string) (time.Duration, error) {
+	param, err := getRequestParam(r, paramName)
+	if err != nil {
+		return 0, err
+	}
+	if seconds, err := strconv.ParseUint(param, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	duration, err := time.ParseDuration(param)
+	if err != nil || duration < 0 {
+		return 0, errors.New(fmt.Sprintf("%s param is not a duration", paramName))
+	}
+	return duration, nil
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Marshal error: %v", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	_, err = w.Write(bytes)
+	if err != nil {
+		fmt.Printf("Can not write response: %v", err.Error())
+	}
+}
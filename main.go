@@ -12,12 +12,14 @@ import (
 )
 
 func main() {
-	closeCh := make(chan struct{})
+	startClients()
+	go deleteLeftTemporaryAudio()
 
+	closeCh := make(chan struct{})
 	httpDone, err := startHttp(closeCh)
 	if err != nil {
-		close(closeCh)
 		fmt.Printf("can not start http server %#v\n", err)
+		closeClients()
 		return
 	}
 
@@ -25,6 +27,8 @@ func main() {
 	if err != nil {
 		close(closeCh)
 		fmt.Printf("can not start pubsub client %#v\n", err)
+		<-httpDone
+		closeClients()
 		return
 	}
 
@@ -44,6 +48,10 @@ func main() {
 		<-pubsubDone
 		<-httpDone
 	}
+	// no new requests, the running jobs and the deliveries still use the shared clients
+	recognitions.drain(shutdownTimeout, interruptRecognition)
+	deliveries.Wait()
+	closeClients()
 }
 
 func startHttp(closeCh <-chan struct{}) (<-chan struct{}, error) {
@@ -54,7 +62,12 @@ func startHttp(closeCh <-chan struct{}) (<-chan struct{}, error) {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/pipeline", pipelineHandler)
+	mux.HandleFunc("/pipeline/export", pipelineExportHandler)
+	mux.HandleFunc("/pipeline/bookmark", bookmarkHandler)
+	mux.HandleFunc("/pipeline/captions", captionsHandler)
 	mux.HandleFunc("/speech-to-text", speechToTextHandler)
+	mux.HandleFunc("/speech-to-text/conversation", conversationHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
 	srv := &http.Server{Handler: mux}
 
 	done := make(chan struct{})
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// metricsHandler exposes the speech-to-text queue and the health of the shared clients in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var b bytes.Buffer
+	metric := func(name, kind, help string, value int64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+	metric("speech_to_text_queue_depth", "gauge", "Requests waiting for a recognition worker.", int64(recognitions.depth()))
+	metric("speech_to_text_queue_capacity", "gauge", "Requests the queue holds before rejecting new ones.", int64(cap(recognitions.jobs)))
+	metric("speech_to_text_workers", "gauge", "Recognition workers.", int64(recognitions.workers))
+	metric("speech_to_text_workers_busy", "gauge", "Recognitions running, every endpoint of a conversation counts.", atomic.LoadInt64(&recognitions.running))
+	metric("speech_to_text_rejected_total", "counter", "Requests rejected because the queue was full.", atomic.LoadInt64(&recognitions.rejected))
+	metric("speech_to_text_retries_total", "counter", "Retried uploads and recognitions.", atomic.LoadInt64(&recognitions.retries))
+	metric("speech_to_text_done_total", "counter", "Requests recognized successfully.", atomic.LoadInt64(&recognitions.done))
+	metric("speech_to_text_failed_total", "counter", "Requests which failed.", atomic.LoadInt64(&recognitions.failed))
+	metric("speech_to_text_cancelled_total", "counter", "Requests cancelled by DELETE /speech-to-text.", atomic.LoadInt64(&recognitions.cancelledCount))
+
+	names, health := clientHealthNames()
+	if len(names) > 0 {
+		fmt.Fprintf(&b, "# HELP shared_client_healthy Whether the last check reached the service of the client.\n# TYPE shared_client_healthy gauge\n")
+	}
+	for _, name := range names {
+		healthy := 0
+		if health[name] {
+			healthy = 1
+		}
+		fmt.Fprintf(&b, "shared_client_healthy{client=%q} %d\n", name, healthy)
+	}
+
+	w.Header().Add("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := w.Write(b.Bytes()); err != nil {
+		fmt.Printf("Can not write response: %v", err.Error())
+	}
+}
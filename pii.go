@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"regexp"
+	gst "rtp-audio-processor/gstreamer-src"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bleepPadding widens bleeped words, as recognizers report word offsets only roughly
+const bleepPadding = time.Millisecond * 100
+
+// bleepFrequency and bleepAmplitude make the tone replacing PII in stored audio
+const bleepFrequency = 1000
+const bleepAmplitude = 8000
+
+// emailPattern matches written addresses and spoken ones like "jane at example dot com"
+var emailPattern = regexp.MustCompile(`(?i)[\w.+-]+@[\w-]+(\.[\w-]+)+|[\w.+-]+ at [\w-]+( dot [\w-]+)+`)
+
+// digitsPattern matches runs of digits with the separators of phone and card numbers, classified by piiMatches
+var digitsPattern = regexp.MustCompile(`\+?\(?\d[\d ().-]*\d`)
+
+// piiMatch is PII found at text[start:end], replaced by its mask.
+type piiMatch struct {
+	start, end int
+	mask       string
+}
+
+// piiMatches finds emails, card numbers (13 to 19 digits passing the Luhn check) and phone numbers (7 to 15 digits) in text.
+func piiMatches(text string) []piiMatch {
+	var matches []piiMatch
+	for _, span := range emailPattern.FindAllStringIndex(text, -1) {
+		matches = append(matches, piiMatch{start: span[0], end: span[1], mask: "[email]"})
+	}
+	for _, span := range digitsPattern.FindAllStringIndex(text, -1) {
+		var digits []byte
+		for _, c := range []byte(text[span[0]:span[1]]) {
+			if c >= '0' && c <= '9' {
+				digits = append(digits, c)
+			}
+		}
+		switch {
+		case len(digits) >= 13 && len(digits) <= 19 && luhnValid(digits):
+			matches = append(matches, piiMatch{start: span[0], end: span[1], mask: "[card]"})
+		case len(digits) >= 7 && len(digits) <= 15:
+			matches = append(matches, piiMatch{start: span[0], end: span[1], mask: "[phone]"})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].start < matches[j].start
+	})
+
+	// an email user name may be a phone number too
+	merged := matches[:0]
+	for _, match := range matches {
+		if last := len(merged) - 1; last >= 0 && match.start < merged[last].end {
+			if match.end > merged[last].end {
+				merged[last].end = match.end
+			}
+			continue
+		}
+		merged = append(merged, match)
+	}
+	return merged
+}
+
+func luhnValid(digits []byte) bool {
+	sum := 0
+	for i := range digits {
+		digit := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			if digit *= 2; digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	return sum%10 == 0
+}
+
+// maskPii replaces the matches in text by their masks.
+func maskPii(text string, matches []piiMatch) string {
+	var masked strings.Builder
+	last := 0
+	for _, match := range matches {
+		masked.WriteString(text[last:match.start])
+		masked.WriteString(match.mask)
+		last = match.end
+	}
+	masked.WriteString(text[last:])
+	return masked.String()
+}
+
+// bleepRange is a stretch of the recognized audio containing PII.
+type bleepRange struct {
+	start, end time.Duration
+}
+
+// redactPii masks PII in the text and words of segments, and returns the time ranges to bleep. The words of a match
+// are merged into one masked word, segments without words are bleeped as a whole when their text contains PII.
+func redactPii(segments []Segment) (int, []bleepRange) {
+	count := 0
+	var bleeps []bleepRange
+	for i := range segments {
+		segment := &segments[i]
+		textMatches := piiMatches(segment.Text)
+		segment.Text = maskPii(segment.Text, textMatches)
+		count += len(textMatches)
+
+		// match the words joined like the text, so PII spanning words is found
+		var joined strings.Builder
+		wordStarts := make([]int, len(segment.Words))
+		for j, word := range segment.Words {
+			if j > 0 {
+				joined.WriteByte(' ')
+			}
+			wordStarts[j] = joined.Len()
+			joined.WriteString(word.Word)
+		}
+		wordMatches := piiMatches(joined.String())
+		if len(wordMatches) == 0 {
+			if len(textMatches) > 0 {
+				bleeps = append(bleeps, bleepRange{start: segment.start(), end: segment.end()})
+			}
+			continue
+		}
+
+		words := segment.Words[:0]
+		matchIndex, masked := 0, false
+		for j, word := range segment.Words {
+			wordEnd := wordStarts[j] + len(word.Word)
+			for matchIndex < len(wordMatches) && wordMatches[matchIndex].end <= wordStarts[j] {
+				matchIndex, masked = matchIndex+1, false
+			}
+			if matchIndex == len(wordMatches) || wordEnd <= wordMatches[matchIndex].start {
+				words = append(words, word)
+				continue
+			}
+			if masked {
+				// a later word of the match extends the masked word
+				words[len(words)-1].EndMs = word.EndMs
+				bleeps[len(bleeps)-1].end = word.end()
+				continue
+			}
+			masked = true
+			word.Word = wordMatches[matchIndex].mask
+			words = append(words, word)
+			bleeps = append(bleeps, bleepRange{start: word.start(), end: word.end()})
+		}
+		segment.Words = words
+	}
+	return count, bleeps
+}
+
+// bleep replaces the ranges of 48kHz mono LINEAR16 audio by a tone.
+func bleep(pcm []byte, ranges []bleepRange) {
+	bleepPart(pcm, 0, ranges)
+}
+
+// bleepPart bleeps the part of the audio starting offset bytes into it, at a sample.
+func bleepPart(pcm []byte, offset int64, ranges []bleepRange) {
+	index := func(d time.Duration) int64 {
+		i := int64(d*gst.SampleRate/time.Second)*gst.BytesPerSample - offset
+		if i < 0 {
+			return 0
+		}
+		if i > int64(len(pcm)) {
+			return int64(len(pcm))
+		}
+		return i
+	}
+	for _, r := range ranges {
+		for i := index(r.start - bleepPadding); i+1 < index(r.end+bleepPadding); i += gst.BytesPerSample {
+			phase := 2 * math.Pi * bleepFrequency * float64((offset+i)/gst.BytesPerSample) / gst.SampleRate
+			binary.LittleEndian.PutUint16(pcm[i:], uint16(int16(bleepAmplitude*math.Sin(phase))))
+		}
+	}
+}
+
+// bleepReader bleeps the ranges of the audio read through it.
+type bleepReader struct {
+	r       io.Reader
+	ranges  []bleepRange
+	offset  int64
+	buffer  []byte
+	pending []byte
+	err     error
+}
+
+func newBleepReader(r io.Reader, ranges []bleepRange) *bleepReader {
+	return &bleepReader{r: r, ranges: ranges, buffer: make([]byte, 64*1024)}
+}
+
+func (b *bleepReader) Read(p []byte) (int, error) {
+	if len(b.pending) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		// whole buffers keep the parts at samples
+		n, err := io.ReadFull(b.r, b.buffer)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		b.err = err
+		b.pending = b.buffer[:n]
+		bleepPart(b.pending, b.offset, b.ranges)
+		b.offset += int64(n)
+		if n == 0 {
+			return 0, b.err
+		}
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	gst "rtp-audio-processor/gstreamer-src"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestLuhnValid(t *testing.T) {
+	tests := []struct {
+		digits string
+		valid  bool
+	}{
+		{"4111111111111111", true},
+		{"4111111111111112", false},
+		{"79927398713", true},
+		{"79927398710", false},
+		{"0", true},
+	}
+	for _, test := range tests {
+		if valid := luhnValid([]byte(test.digits)); valid != test.valid {
+			t.Errorf("luhnValid(%v) = %v, want %v", test.digits, valid, test.valid)
+		}
+	}
+}
+
+func TestPiiMatches(t *testing.T) {
+	tests := []struct {
+		text   string
+		masked string
+	}{
+		{"no numbers here", "no numbers here"},
+		{"call me at +1 (555) 123-4567 tomorrow", "call me at [phone] tomorrow"},
+		{"my card is 4111 1111 1111 1111 thanks", "my card is [card] thanks"},
+		// 16 digits failing the Luhn check are too long for a phone number
+		{"order 4111 1111 1111 1112", "order 4111 1111 1111 1112"},
+		{"it costs 125 dollars", "it costs 125 dollars"},
+		{"write to jane.doe@example.com", "write to [email]"},
+		{"write to jane at example dot com please", "write to [email] please"},
+		// the user name of the email is a phone number too, merged into one match
+		{"5551234567@example.com", "[email]"},
+		{"two 555-1234 and 555-9876", "two [phone] and [phone]"},
+	}
+	for _, test := range tests {
+		if masked := maskPii(test.text, piiMatches(test.text)); masked != test.masked {
+			t.Errorf("masked %q as %q, want %q", test.text, masked, test.masked)
+		}
+	}
+}
+
+func TestRedactPii(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []Segment
+		redacted []Segment
+		count    int
+		bleeps   []bleepRange
+	}{
+		{
+			name:     "nothing to redact",
+			segments: []Segment{{Text: "hello", Words: []Word{{Word: "hello", StartMs: 0, EndMs: 500}}}},
+			redacted: []Segment{{Text: "hello", Words: []Word{{Word: "hello", StartMs: 0, EndMs: 500}}}},
+		},
+		{
+			name: "words of a number merged",
+			segments: []Segment{{Text: "call 555 123 4567 now", Words: []Word{
+				{Word: "call", StartMs: 0, EndMs: 400},
+				{Word: "555", StartMs: 500, EndMs: 900},
+				{Word: "123", StartMs: 1000, EndMs: 1400},
+				{Word: "4567", StartMs: 1500, EndMs: 2000},
+				{Word: "now", StartMs: 2100, EndMs: 2400},
+			}}},
+			redacted: []Segment{{Text: "call [phone] now", Words: []Word{
+				{Word: "call", StartMs: 0, EndMs: 400},
+				{Word: "[phone]", StartMs: 500, EndMs: 2000},
+				{Word: "now", StartMs: 2100, EndMs: 2400},
+			}}},
+			count:  1,
+			bleeps: []bleepRange{{start: 500 * time.Millisecond, end: 2000 * time.Millisecond}},
+		},
+		{
+			name: "two matches in a segment",
+			segments: []Segment{{Text: "555-1234 or a@b.com", Words: []Word{
+				{Word: "555-1234", StartMs: 0, EndMs: 800},
+				{Word: "or", StartMs: 900, EndMs: 1000},
+				{Word: "a@b.com", StartMs: 1100, EndMs: 1900},
+			}}},
+			redacted: []Segment{{Text: "[phone] or [email]", Words: []Word{
+				{Word: "[phone]", StartMs: 0, EndMs: 800},
+				{Word: "or", StartMs: 900, EndMs: 1000},
+				{Word: "[email]", StartMs: 1100, EndMs: 1900},
+			}}},
+			count:  2,
+			bleeps: []bleepRange{{end: 800 * time.Millisecond}, {start: 1100 * time.Millisecond, end: 1900 * time.Millisecond}},
+		},
+		{
+			name:     "segment without words bleeped as a whole",
+			segments: []Segment{{StartMs: 1000, EndMs: 3000, Text: "mail a@b.com"}},
+			redacted: []Segment{{StartMs: 1000, EndMs: 3000, Text: "mail [email]"}},
+			count:    1,
+			bleeps:   []bleepRange{{start: time.Second, end: 3 * time.Second}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			count, bleeps := redactPii(test.segments)
+			if count != test.count {
+				t.Errorf("%v redactions, want %v", count, test.count)
+			}
+			if !reflect.DeepEqual(test.segments, test.redacted) {
+				t.Errorf("redacted %+v, want %+v", test.segments, test.redacted)
+			}
+			if !reflect.DeepEqual(bleeps, test.bleeps) {
+				t.Errorf("bleeps %+v, want %+v", bleeps, test.bleeps)
+			}
+		})
+	}
+}
+
+func TestBleep(t *testing.T) {
+	samples := 2 * gst.SampleRate
+	pcm := make([]byte, samples*gst.BytesPerSample)
+	for i := 0; i < samples; i++ {
+		binary.LittleEndian.PutUint16(pcm[i*gst.BytesPerSample:], 7)
+	}
+	ranges := []bleepRange{{start: 500 * time.Millisecond, end: time.Second}, {start: 1900 * time.Millisecond, end: 3 * time.Second}}
+	bleeped := append([]byte(nil), pcm...)
+	bleep(bleeped, ranges)
+
+	sample := func(pcm []byte, at time.Duration) int16 {
+		return int16(binary.LittleEndian.Uint16(pcm[int(at*gst.SampleRate/time.Second)*gst.BytesPerSample:]))
+	}
+	tests := []struct {
+		at      time.Duration
+		bleeped bool
+	}{
+		{0, false},
+		{400*time.Millisecond - time.Millisecond, false}, // before the padding
+		{400 * time.Millisecond, true},
+		{750 * time.Millisecond, true},
+		{1100*time.Millisecond - time.Millisecond, true},
+		{1100 * time.Millisecond, false},
+		{1850 * time.Millisecond, true}, // up to the end of the audio
+		{2*time.Second - time.Millisecond, true},
+	}
+	// no sample of the tone is 7
+	for _, test := range tests {
+		if bleeped := sample(bleeped, test.at) != 7; bleeped != test.bleeped {
+			t.Errorf("sample at %v bleeped %v, want %v", test.at, bleeped, test.bleeped)
+		}
+	}
+
+	// read through a bleepReader in odd parts, the audio is bleeped the same
+	read, err := io.ReadAll(iotest.OneByteReader(newBleepReader(iotest.HalfReader(bytes.NewReader(pcm)), ranges)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, bleeped) {
+		t.Error("audio bleeped by the reader differs")
+	}
+}
+
+func TestCaptionEventRedactsPii(t *testing.T) {
+	result := StreamingResult{Transcript: "call me at 555-1234 about the refund", IsFinal: true}
+	tests := []struct {
+		redactPii  bool
+		transcript string
+	}{
+		{false, "call me at 555-1234 about the refund"},
+		{true, "call me at [phone] about the refund"},
+	}
+	for _, test := range tests {
+		session := &captionsSession{pipelineId: "p1", redactPii: test.redactPii}
+		event := session.event("e1", result)
+		if event.Transcript != test.transcript || event.PipelineId != "p1" || event.Endpoint != "e1" || !event.IsFinal {
+			t.Errorf("redactPii=%v: event %+v, want transcript %q", test.redactPii, event, test.transcript)
+		}
+	}
+}
@@ -14,6 +14,11 @@ type PipelineInfo struct {
 }
 
 func pipelineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		pipelineInspectHandler(w, r)
+		return
+	}
+
 	id, err := getRequestParam(r, "id")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -59,7 +64,7 @@ func pipelineHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		log.Printf("UpdatePipeline(id=%s, Ssrcs=%#v, Speakers=%#v)\n", id, pipelineInfo.Ssrcs, pipelineInfo.Speakers)
-		err = gst.UpdatePipeline(id, pipelineInfo.Ssrcs, pipelineInfo.Speakers)
+		err = updatePipeline(id, pipelineInfo.Ssrcs, pipelineInfo.Speakers)
 		if err == nil {
 			fmt.Fprintf(w, "OK")
 		} else {
@@ -85,3 +90,23 @@ func pipelineHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 	}
 }
+
+// pipelineInspectHandler describes live and retained pipelines, or only the one with the given id.
+func pipelineInspectHandler(w http.ResponseWriter, r *http.Request) {
+	id := ""
+	if hasRequestParam(r, "id") {
+		var err error
+		id, err = getRequestParam(r, "id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	states := gst.InspectPipelines(id)
+	if id != "" && len(states) == 0 {
+		http.Error(w, gst.NewPipelineNotFoundError(id).Error(), http.StatusNotFound)
+		return
+	}
+	writeJson(w, states)
+}
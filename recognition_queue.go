@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// recognitionBackoff is the wait before the first retry of a failed upload or recognition, doubling for every next one
+const recognitionBackoff = time.Second * 5
+
+var errRecognitionQueueFull = errors.New("recognition queue is full, try again later")
+var errRecognitionQueueClosed = errors.New("recognition queue is closed by shutdown")
+
+// recognitionQueue runs speech-to-text jobs on a fixed number of workers. Requests reserve a place
+// in the queue before exporting, and are rejected with errRecognitionQueueFull once it is full.
+// Jobs take a slot for every recognition they run, so the endpoints of conversations count against
+// the workers too.
+type recognitionQueue struct {
+	jobs     chan recognitionJob
+	workers  int
+	slots    chan struct{}
+	reserved int // places taken by jobs which are exported but not submitted yet
+	// queued and running jobs by request id, until the result is finished
+	cancels     map[string]context.CancelFunc
+	cancelled   map[string]bool
+	interrupted map[string]bool
+	// jobs waiting for a worker by request id
+	queued map[string]recognitionJob
+	mutex  sync.Mutex
+	// closed by drain, which drops the queued jobs by interrupt
+	closed    bool
+	interrupt func(requestId string)
+	working   sync.WaitGroup
+
+	// counters for /metrics, updated atomically
+	running        int64
+	rejected       int64
+	retries        int64
+	done           int64
+	failed         int64
+	cancelledCount int64
+}
+
+// recognitionJob runs the recognition of a request, or discards its export when it is cancelled while queued.
+type recognitionJob struct {
+	requestId string
+	run       func()
+	discard   func()
+}
+
+var recognitions *recognitionQueue
+
+// recognitionRetries is how many times a retryable upload or recognition error is retried
+var recognitionRetries int
+
+// shutdownTimeout is how long running jobs may take to finish on shutdown before they are cancelled
+var shutdownTimeout time.Duration
+
+func init() {
+	workers := getEnvPositiveInt("RECOGNITION_WORKERS", 4)
+	queueSize := getEnvPositiveInt("RECOGNITION_QUEUE_SIZE", 100)
+	recognitionRetries = 3
+	if value, isEnvSet := os.LookupEnv("RECOGNITION_RETRIES"); isEnvSet {
+		var err error
+		recognitionRetries, err = strconv.Atoi(value)
+		if err != nil || recognitionRetries < 0 {
+			panic(fmt.Sprintf("environment variable RECOGNITION_RETRIES is not a number: %v", value))
+		}
+	}
+	shutdownTimeout = time.Duration(getEnvPositiveInt("SHUTDOWN_TIMEOUT", 30)) * time.Second
+	recognitions = newRecognitionQueue(workers, queueSize)
+}
+
+func getEnvPositiveInt(name string, defaultValue int) int {
+	value, isEnvSet := os.LookupEnv(name)
+	if !isEnvSet {
+		return defaultValue
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number <= 0 {
+		panic(fmt.Sprintf("environment variable %v is not a positive number: %v", name, value))
+	}
+	return number
+}
+
+func newRecognitionQueue(workers, queueSize int) *recognitionQueue {
+	q := &recognitionQueue{
+		jobs:        make(chan recognitionJob, queueSize),
+		workers:     workers,
+		slots:       make(chan struct{}, workers),
+		cancels:     make(map[string]context.CancelFunc),
+		cancelled:   make(map[string]bool),
+		interrupted: make(map[string]bool),
+		queued:      make(map[string]recognitionJob),
+	}
+	q.working.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+func (q *recognitionQueue) work() {
+	defer q.working.Done()
+	for job := range q.jobs {
+		if !q.start(job.requestId) {
+			// cancelled while queued, or dropped by drain
+			continue
+		}
+		job.run()
+	}
+}
+
+// acquire waits for a free slot to run a recognition in, until ctx is done.
+func (q *recognitionQueue) acquire(ctx context.Context) error {
+	select {
+	case q.slots <- struct{}{}:
+		atomic.AddInt64(&q.running, 1)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// vacate frees the slot taken by acquire.
+func (q *recognitionQueue) vacate() {
+	atomic.AddInt64(&q.running, -1)
+	<-q.slots
+}
+
+// start takes the job of the request off the queued ones, false when it was cancelled meanwhile.
+func (q *recognitionQueue) start(requestId string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	_, queued := q.queued[requestId]
+	delete(q.queued, requestId)
+	return queued
+}
+
+// reserve takes a place in the queue, to be used by submit or given back by release.
+func (q *recognitionQueue) reserve() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return errRecognitionQueueClosed
+	}
+	if q.reserved+len(q.jobs) >= cap(q.jobs) {
+		atomic.AddInt64(&q.rejected, 1)
+		return errRecognitionQueueFull
+	}
+	q.reserved++
+	return nil
+}
+
+func (q *recognitionQueue) release() {
+	q.mutex.Lock()
+	q.reserved--
+	q.mutex.Unlock()
+}
+
+// submit queues the job of the request in the reserved place. cancel stops the job, it is called by cancel and end.
+// discard closes the export of the job when it is cancelled before a worker runs it.
+func (q *recognitionQueue) submit(requestId string, cancel context.CancelFunc, run func(), discard func()) {
+	q.mutex.Lock()
+	q.reserved--
+	q.cancels[requestId] = cancel
+	if q.closed {
+		// only reserved before drain
+		q.mutex.Unlock()
+		discard()
+		q.interrupt(requestId)
+		return
+	}
+	job := recognitionJob{requestId: requestId, run: run, discard: discard}
+	q.queued[requestId] = job
+	q.jobs <- job
+	q.mutex.Unlock()
+}
+
+// cancel stops the job of the request, ok is false when there is no such job (any more). A job still waiting
+// for a worker is dropped and its export discarded, queued tells the caller to finish its result.
+func (q *recognitionQueue) cancel(requestId string) (queued bool, ok bool) {
+	q.mutex.Lock()
+	cancel, ok := q.cancels[requestId]
+	job, queued := q.queued[requestId]
+	if ok {
+		q.cancelled[requestId] = true
+		cancel()
+		delete(q.queued, requestId)
+	}
+	q.mutex.Unlock()
+
+	if queued {
+		job.discard()
+	}
+	return queued, ok
+}
+
+// end forgets the finished job of the request, telling whether it was cancelled or interrupted by drain.
+func (q *recognitionQueue) end(requestId string) (cancelled bool, interrupted bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if cancel, ok := q.cancels[requestId]; ok {
+		cancel()
+	}
+	cancelled, interrupted = q.cancelled[requestId], q.interrupted[requestId]
+	delete(q.cancels, requestId)
+	delete(q.cancelled, requestId)
+	delete(q.interrupted, requestId)
+	return cancelled, interrupted
+}
+
+// drain stops taking jobs and drops the queued ones, calling interrupt to finish them. Running jobs get
+// timeout to finish, then they are cancelled and get timeout once more to stop.
+func (q *recognitionQueue) drain(timeout time.Duration, interrupt func(requestId string)) {
+	q.mutex.Lock()
+	if !q.closed {
+		q.closed = true
+		q.interrupt = interrupt
+		close(q.jobs)
+	}
+	queued := q.queued
+	q.queued = make(map[string]recognitionJob)
+	q.mutex.Unlock()
+
+	for requestId, job := range queued {
+		job.discard()
+		interrupt(requestId)
+	}
+	fmt.Printf("dropped %v queued recognition jobs, waiting up to %v for %v running ones\n",
+		len(queued), timeout, q.runningJobs())
+
+	done := make(chan struct{})
+	go func() {
+		q.working.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	q.mutex.Lock()
+	fmt.Printf("cancelling %v recognition jobs still running\n", len(q.cancels))
+	for requestId, cancel := range q.cancels {
+		q.interrupted[requestId] = true
+		cancel()
+	}
+	q.mutex.Unlock()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		fmt.Printf("recognition jobs did not stop in %v\n", timeout)
+	}
+}
+
+// runningJobs is the number of jobs taken by workers and not finished yet.
+func (q *recognitionQueue) runningJobs() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.cancels) - len(q.queued)
+}
+
+// depth is the number of jobs waiting for a worker.
+func (q *recognitionQueue) depth() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.reserved + len(q.jobs)
+}
+
+// finished counts a finished job by its status.
+func (q *recognitionQueue) finished(status ResultStatus) {
+	switch status {
+	case StatusDone:
+		atomic.AddInt64(&q.done, 1)
+	case StatusFailed:
+		atomic.AddInt64(&q.failed, 1)
+	case StatusCancelled:
+		atomic.AddInt64(&q.cancelledCount, 1)
+	}
+}
+
+// temporaryError marks errors of recognizers and storages which are worth retrying, e.g. 5xx responses.
+type temporaryError struct {
+	err error
+}
+
+func (e *temporaryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *temporaryError) Unwrap() error {
+	return e.err
+}
+
+// isRetryable tells temporary errors, unavailable or overloaded Google APIs and network failures.
+// Timed out and cancelled jobs are not retried, although context errors are net errors too.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var temporary *temporaryError
+	if errors.As(err, &temporary) {
+		return true
+	}
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		switch grpcErr.GRPCStatus().Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.Internal, codes.DeadlineExceeded:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retryRecognition runs attempt until it succeeds or fails with an error which is not retryable,
+// at most recognitionRetries times more, counting the retries in the result.
+func retryRecognition(ctx context.Context, requestId string, attempt func() error) error {
+	backoff := recognitionBackoff
+	for retry := 0; ; retry++ {
+		err := attempt()
+		if err == nil || retry == recognitionRetries || !isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+		fmt.Printf("request %v attempt failed, retrying in %v: %v\n", requestId, backoff, err)
+		atomic.AddInt64(&recognitions.retries, 1)
+		results.Update(requestId, func(result *Result) {
+			result.Retries++
+		})
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
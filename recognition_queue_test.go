@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"temporary", &temporaryError{errors.New("503")}, true},
+		{"unavailable", status.Error(codes.Unavailable, "unavailable"), true},
+		{"invalid argument", status.Error(codes.InvalidArgument, "bad audio"), false},
+		{"network", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"timed out", fmt.Errorf("recognize: %w", context.DeadlineExceeded), false},
+		{"timed out grpc", fmt.Errorf("%v: %w", status.Error(codes.DeadlineExceeded, "deadline"), context.DeadlineExceeded), false},
+		{"cancelled", context.Canceled, false},
+		{"other", errors.New("unsupported audio uri"), false},
+	}
+	for _, test := range tests {
+		if retryable := isRetryable(test.err); retryable != test.retryable {
+			t.Errorf("%v: retryable %v, want %v", test.name, retryable, test.retryable)
+		}
+	}
+}
+
+func TestRecognitionQueueCancelQueued(t *testing.T) {
+	q := newRecognitionQueue(1, 10)
+	block, blocked := make(chan bool), make(chan bool)
+	_, cancelRunning := context.WithCancel(context.Background())
+	q.reserve()
+	q.submit("running", cancelRunning, func() {
+		blocked <- true
+		<-block
+	}, func() {})
+	<-blocked
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ran, discarded := false, false
+	q.reserve()
+	q.submit("queued", cancel, func() {
+		ran = true
+	}, func() {
+		discarded = true
+	})
+
+	if queued, ok := q.cancel("queued"); !queued || !ok {
+		t.Errorf("cancel of the queued job: queued %v, ok %v", queued, ok)
+	}
+	if !discarded || ctx.Err() == nil {
+		t.Errorf("cancelled queued job: discarded %v, context %v", discarded, ctx.Err())
+	}
+	if cancelled, _ := q.end("queued"); !cancelled {
+		t.Error("queued job not ended as cancelled")
+	}
+	if queued, ok := q.cancel("running"); queued || !ok {
+		t.Errorf("cancel of the running job: queued %v, ok %v", queued, ok)
+	}
+	close(block)
+	q.end("running")
+
+	// the worker skips the cancelled job
+	time.Sleep(10 * time.Millisecond)
+	if ran {
+		t.Error("cancelled queued job ran")
+	}
+}
+
+func TestRecognitionQueueSlots(t *testing.T) {
+	q := newRecognitionQueue(2, 10)
+	for i := 0; i < 2; i++ {
+		if err := q.acquire(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire of a third slot: %v, want %v", err, context.DeadlineExceeded)
+	}
+	if running := atomic.LoadInt64(&q.running); running != 2 {
+		t.Errorf("%v running, want 2", running)
+	}
+	q.vacate()
+	if err := q.acquire(context.Background()); err != nil {
+		t.Errorf("acquire of a vacated slot: %v", err)
+	}
+}
+
+func TestRecognitionQueueDrain(t *testing.T) {
+	q := newRecognitionQueue(1, 10)
+	started := make(chan bool)
+	runningInterrupted := false
+	runningCtx, cancelRunning := context.WithCancel(context.Background())
+	q.reserve()
+	q.submit("running", cancelRunning, func() {
+		started <- true
+		// ignores the shutdown until it is cancelled
+		<-runningCtx.Done()
+		_, runningInterrupted = q.end("running")
+	}, func() {})
+	<-started
+
+	ran, discarded := false, false
+	_, cancelQueued := context.WithCancel(context.Background())
+	q.reserve()
+	q.submit("queued", cancelQueued, func() {
+		ran = true
+	}, func() {
+		discarded = true
+	})
+
+	var interrupted []string
+	start := time.Now()
+	q.drain(50*time.Millisecond, func(requestId string) {
+		interrupted = append(interrupted, requestId)
+		q.end(requestId)
+	})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("drain took %v with a timeout of 50ms", elapsed)
+	}
+	if runningCtx.Err() == nil || !runningInterrupted {
+		t.Errorf("running job cancelled %v, interrupted %v after the timeout", runningCtx.Err(), runningInterrupted)
+	}
+	if ran || !discarded || len(interrupted) != 1 || interrupted[0] != "queued" {
+		t.Errorf("queued job ran %v, discarded %v, interrupted %v", ran, discarded, interrupted)
+	}
+	if err := q.reserve(); !errors.Is(err, errRecognitionQueueClosed) {
+		t.Errorf("reserve after drain: %v, want %v", err, errRecognitionQueueClosed)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	gst "rtp-audio-processor/gstreamer-src"
+	"strings"
+	"time"
+)
+
+// RecognitionAudio is mono audio, sent Inline as 48kHz LINEAR16 Content or uploaded to Uri
+// in Encoding at SampleRate.
+type RecognitionAudio struct {
+	Uri        string
+	Encoding   AudioEncoding
+	SampleRate int
+	// Inline tells that the audio is Content, which is empty for a window without audio
+	Inline  bool
+	Content []byte
+	// trim maps offsets into audio with shortened silences back to the exported audio
+	trim *silenceTrim
+	// spool keeps the recognized audio until it is released
+	spool *audioSpool
+	// exported keeps the exported audio when the recognized audio is trimmed and the exported one is kept
+	exported *audioSpool
+	// keep tells whether the exported audio is stored, as keptUri which is reported as the audio uri of the result
+	keep    bool
+	keptUri string
+	// temporary tells that Uri is only stored for the recognizer, and deleted on release
+	temporary bool
+	// requestId is the request whose result tracks the temporary Uri
+	requestId string
+}
+
+// exportedSpool is the spooled exported audio, for keeping it.
+func (a *RecognitionAudio) exportedSpool() *audioSpool {
+	if a.exported != nil {
+		return a.exported
+	}
+	return a.spool
+}
+
+// release removes the spooled audio and the temporary upload, once the audio is recognized and kept.
+// Releasing it again does nothing.
+func (a *RecognitionAudio) release() {
+	for _, spool := range []*audioSpool{a.spool, a.exported} {
+		if spool == nil {
+			continue
+		}
+		if err := spool.Close(); err != nil {
+			fmt.Printf("can not remove spooled audio: %v\n", err)
+		}
+	}
+	a.spool, a.exported = nil, nil
+	if a.temporary && a.Uri != "" {
+		// the context of the request may be gone, e.g. by the timeout which failed it
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		deleteTemporaryAudio(ctx, a.requestId, a.Uri)
+	}
+	a.temporary = false
+}
+
+// content returns the inline or spooled audio, or reads back the uploaded one when it is 48kHz LINEAR16 too.
+func (a *RecognitionAudio) content(ctx context.Context) ([]byte, error) {
+	if a.Inline {
+		return a.Content, nil
+	}
+	if a.spool != nil {
+		return io.ReadAll(a.spool.open())
+	}
+	if a.Encoding != EncodingLinear16 || a.SampleRate != gst.SampleRate {
+		return nil, fmt.Errorf("can not read %v audio at %vHz from %v", a.Encoding, a.SampleRate, a.Uri)
+	}
+	return readStoredAudio(ctx, a.Uri)
+}
+
+type RecognitionConfig struct {
+	LanguageCode string
+	// AlternativeLanguageCodes may be spoken instead of LanguageCode, the result tells which one was detected
+	AlternativeLanguageCodes []string
+	// AutoDetectLanguage lets recognizers which can detect any language ignore the language codes
+	AutoDetectLanguage         bool
+	EnableAutomaticPunctuation bool
+	EnableWordTimeOffsets      bool
+	EnableWordConfidence       bool
+	ProfanityFilter            bool
+	Model                      string
+	UseEnhanced                bool
+	// Phrases hint the recognizer at words likely to be said, e.g. the room topic or participant names
+	Phrases []string
+}
+
+type Recognizer interface {
+	// MaxInlineDuration is the longest audio the recognizer takes as inline content, longer audio is uploaded.
+	MaxInlineDuration() time.Duration
+	// Recognize transcribes the audio, reporting progress of long recognitions when the backend knows it.
+	Recognize(ctx context.Context, audio *RecognitionAudio, config *RecognitionConfig, progress func(percent int32)) ([]Segment, error)
+}
+
+// StreamingResult is an interim or final result of live recognition, with capture times of the audio it covers.
+type StreamingResult struct {
+	Transcript   string
+	IsFinal      bool
+	Stability    float32
+	Confidence   float32
+	StartTime    time.Time
+	EndTime      time.Time
+	LanguageCode string
+}
+
+// StreamingRecognizer is implemented by recognizers which can transcribe live audio.
+type StreamingRecognizer interface {
+	// RecognizeStream transcribes audio until the channel is closed or ctx is done, calling onResult for every result.
+	RecognizeStream(ctx context.Context, audio <-chan gst.Chunk, config *RecognitionConfig, onResult func(StreamingResult)) error
+}
+
+var recognizers map[string]Recognizer
+var defaultRecognizer string
+
+func init() {
+	recognizers = map[string]Recognizer{
+		"google": &googleRecognizer{},
+		"local":  newLocalRecognizer(os.Getenv("LOCAL_RECOGNIZER_URL")),
+		"fake":   newFakeRecognizer(os.Getenv("FAKE_RECOGNIZER_TRANSCRIPT")),
+	}
+
+	autoLanguageCodes = strings.Split("en-US,es-ES,fr-FR,de-DE", ",")
+	if codes := os.Getenv("AUTO_LANGUAGE_CODES"); codes != "" {
+		autoLanguageCodes = strings.Split(codes, ",")
+	}
+	if len(autoLanguageCodes) > 1+maxAlternativeLanguageCodes {
+		panic(fmt.Sprintf("environment variable AUTO_LANGUAGE_CODES has more than %v languages", 1+maxAlternativeLanguageCodes))
+	}
+
+	defaultRecognizer = os.Getenv("RECOGNIZER")
+	if defaultRecognizer == "" {
+		defaultRecognizer = "google"
+	}
+	if _, ok := recognizers[defaultRecognizer]; !ok {
+		panic(fmt.Sprintf("environment variable RECOGNIZER has unknown value %v", defaultRecognizer))
+	}
+}
+
+// maxAlternativeLanguageCodes is the most alternative languages the Google recognizer accepts
+const maxAlternativeLanguageCodes = 3
+
+// autoLanguageCodes are the candidate languages of languageCode=auto
+var autoLanguageCodes []string
+
+// parseRecognitionConfig reads languageCode (a language, comma separated candidate languages or auto) and the optional punctuation, wordTimeOffsets, wordConfidence,
+// profanityFilter, enhanced (bool), model and phrases (comma separated) params.
+func parseRecognitionConfig(r *http.Request) (*RecognitionConfig, error) {
+	languageCode, err := getRequestParam(r, "languageCode")
+	if err != nil {
+		return nil, err
+	}
+	config := &RecognitionConfig{}
+	languageCodes := strings.Split(languageCode, ",")
+	if languageCode == "auto" {
+		config.AutoDetectLanguage = true
+		languageCodes = append([]string(nil), autoLanguageCodes...)
+	}
+	for i, code := range languageCodes {
+		if languageCodes[i] = strings.TrimSpace(code); languageCodes[i] == "" {
+			return nil, errors.New("languageCode param error")
+		}
+	}
+	if len(languageCodes) > 1+maxAlternativeLanguageCodes {
+		return nil, fmt.Errorf("languageCode param error, at most %v languages are supported", 1+maxAlternativeLanguageCodes)
+	}
+	config.LanguageCode = languageCodes[0]
+	config.AlternativeLanguageCodes = languageCodes[1:]
+
+	flags := map[string]*bool{
+		"punctuation":     &config.EnableAutomaticPunctuation,
+		"wordTimeOffsets": &config.EnableWordTimeOffsets,
+		"wordConfidence":  &config.EnableWordConfidence,
+		"profanityFilter": &config.ProfanityFilter,
+		"enhanced":        &config.UseEnhanced,
+	}
+	for paramName, flag := range flags {
+		if hasRequestParam(r, paramName) {
+			*flag, err = getRequestParamBool(r, paramName)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if hasRequestParam(r, "model") {
+		config.Model, err = getRequestParam(r, "model")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if hasRequestParam(r, "phrases") {
+		phrases, err := getRequestParam(r, "phrases")
+		if err != nil {
+			return nil, err
+		}
+		for _, phrase := range strings.Split(phrases, ",") {
+			if phrase = strings.TrimSpace(phrase); phrase != "" {
+				config.Phrases = append(config.Phrases, phrase)
+			}
+		}
+	}
+	return config, nil
+}
+
+// detectedLanguage is the language most of the transcript was recognized in.
+func detectedLanguage(segments []Segment) string {
+	lengths := make(map[string]int)
+	for _, segment := range segments {
+		if segment.LanguageCode != "" {
+			lengths[segment.LanguageCode] += len(segment.Text)
+		}
+	}
+	return longestLanguage(lengths)
+}
+
+func longestLanguage(lengths map[string]int) string {
+	language, longest := "", -1
+	for code, length := range lengths {
+		if length > longest || (length == longest && code < language) {
+			language, longest = code, length
+		}
+	}
+	return language
+}
+
+func getRecognizer(name string) (Recognizer, error) {
+	if recognizer, ok := recognizers[name]; ok {
+		return recognizer, nil
+	}
+	return nil, fmt.Errorf("unknown recognizer %v", name)
+}
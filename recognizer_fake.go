@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	gst "rtp-audio-processor/gstreamer-src"
+	"strings"
+	"time"
+)
+
+// fakeRecognizer deterministically "recognizes" the configured transcript, spreading its words evenly over the audio.
+type fakeRecognizer struct {
+	words []string
+}
+
+func newFakeRecognizer(transcript string) *fakeRecognizer {
+	if transcript == "" {
+		transcript = "fake transcript"
+	}
+	return &fakeRecognizer{words: strings.Fields(transcript)}
+}
+
+func (r *fakeRecognizer) MaxInlineDuration() time.Duration {
+	return gst.RingBufferDuration
+}
+
+func (r *fakeRecognizer) Recognize(ctx context.Context, audio *RecognitionAudio, config *RecognitionConfig, _ func(percent int32)) ([]Segment, error) {
+	pcm, err := audio.content(ctx)
+	if err != nil {
+		return nil, err
+	}
+	duration := time.Duration(len(pcm)/gst.BytesPerSample) * time.Second / gst.SampleRate
+
+	words := make([]Word, 0, len(r.words))
+	for i, word := range r.words {
+		words = append(words, Word{
+			Word:       word,
+			StartMs:    (duration * time.Duration(i) / time.Duration(len(r.words))).Milliseconds(),
+			EndMs:      (duration * time.Duration(i+1) / time.Duration(len(r.words))).Milliseconds(),
+			Confidence: 1,
+		})
+	}
+	return []Segment{{
+		EndMs:        duration.Milliseconds(),
+		Text:         strings.Join(r.words, " "),
+		Confidence:   1,
+		LanguageCode: strings.ToLower(config.LanguageCode),
+		Words:        words,
+	}}, nil
+}
+
+// RecognizeStream "recognizes" one more word of the transcript per second of audio as interim results,
+// and the recognized words as a final result when the audio ends.
+func (r *fakeRecognizer) RecognizeStream(ctx context.Context, audio <-chan gst.Chunk, config *RecognitionConfig, onResult func(StreamingResult)) error {
+	var start, end time.Time
+	var duration time.Duration
+	words := 0
+	result := func(isFinal bool) StreamingResult {
+		return StreamingResult{
+			Transcript:   strings.Join(r.words[:words], " "),
+			IsFinal:      isFinal,
+			Stability:    0.5,
+			Confidence:   1,
+			StartTime:    start,
+			EndTime:      end,
+			LanguageCode: strings.ToLower(config.LanguageCode),
+		}
+	}
+
+	for {
+		select {
+		case chunk, ok := <-audio:
+			if !ok {
+				if words > 0 {
+					onResult(result(true))
+				}
+				return nil
+			}
+			if start.IsZero() {
+				start = chunk.Time
+			}
+			end = chunk.Time.Add(chunk.Duration())
+			duration += chunk.Duration()
+			if seconds := int(duration / time.Second); seconds > words && words < len(r.words) {
+				words++
+				onResult(result(false))
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	speech "cloud.google.com/go/speech/apiv1"
+	"context"
+	"fmt"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+	longrunningpb "google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	gst "rtp-audio-processor/gstreamer-src"
+	"strings"
+	"sync"
+	"time"
+)
+
+// googlePollInterval is how often the long-running operation is polled for progress
+const googlePollInterval = time.Second * 10
+
+// googleRecognizer shares one speech client between recognitions, see startClients.
+type googleRecognizer struct {
+	client      *speech.Client
+	closed      bool
+	clientMutex sync.Mutex
+}
+
+// connect creates the client unless it exists already.
+func (r *googleRecognizer) connect() error {
+	_, err := r.getClient()
+	return err
+}
+
+func (r *googleRecognizer) getClient() (*speech.Client, error) {
+	r.clientMutex.Lock()
+	defer r.clientMutex.Unlock()
+
+	if r.closed {
+		return nil, errClientClosed
+	}
+	if r.client == nil {
+		client, err := speech.NewClient(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("can not create speech client: %w", err)
+		}
+		r.client = client
+	}
+	return r.client, nil
+}
+
+func (r *googleRecognizer) healthName() string {
+	return "speech"
+}
+
+// checkHealth gets an operation which does not exist, the speech API tells so when it is reachable.
+func (r *googleRecognizer) checkHealth(ctx context.Context) error {
+	client, err := r.getClient()
+	if err != nil {
+		return err
+	}
+	_, err = client.LROClient.GetOperation(ctx, &longrunningpb.GetOperationRequest{Name: "health-check"})
+	if code := status.Code(err); code == codes.NotFound || code == codes.InvalidArgument {
+		return nil
+	}
+	return err
+}
+
+func (r *googleRecognizer) Close() error {
+	r.clientMutex.Lock()
+	defer r.clientMutex.Unlock()
+
+	r.closed = true
+	if r.client == nil {
+		return nil
+	}
+	err := r.client.Close()
+	r.client = nil
+	return err
+}
+
+func googleRecognitionConfig(config *RecognitionConfig) *speechpb.RecognitionConfig {
+	recognitionConfig := &speechpb.RecognitionConfig{
+		Encoding:                   speechpb.RecognitionConfig_LINEAR16,
+		SampleRateHertz:            gst.SampleRate,
+		LanguageCode:               config.LanguageCode,
+		AlternativeLanguageCodes:   config.AlternativeLanguageCodes,
+		AudioChannelCount:          1,
+		EnableAutomaticPunctuation: config.EnableAutomaticPunctuation,
+		EnableWordTimeOffsets:      config.EnableWordTimeOffsets,
+		EnableWordConfidence:       config.EnableWordConfidence,
+		ProfanityFilter:            config.ProfanityFilter,
+		Model:                      config.Model,
+		UseEnhanced:                config.UseEnhanced,
+	}
+	if len(config.Phrases) > 0 {
+		recognitionConfig.SpeechContexts = []*speechpb.SpeechContext{{Phrases: config.Phrases}}
+	}
+	return recognitionConfig
+}
+
+// MaxInlineDuration is the limit of synchronous recognition.
+func (*googleRecognizer) MaxInlineDuration() time.Duration {
+	return time.Minute
+}
+
+func (r *googleRecognizer) Recognize(ctx context.Context, audio *RecognitionAudio, config *RecognitionConfig, progress func(percent int32)) ([]Segment, error) {
+	speechClient, err := r.getClient()
+	if err != nil {
+		return nil, err
+	}
+	if audio.Inline {
+		return recognizeGoogleInline(ctx, speechClient, audio.Content, config)
+	}
+	if !strings.HasPrefix(audio.Uri, "gs://") {
+		return nil, fmt.Errorf("google recognizer can only read audio from gcs storage, got %v", audio.Uri)
+	}
+
+	recognitionConfig := googleRecognitionConfig(config)
+	recognitionConfig.SampleRateHertz = int32(audio.SampleRate)
+	if audio.Encoding == EncodingFlac {
+		recognitionConfig.Encoding = speechpb.RecognitionConfig_FLAC
+	}
+	req := &speechpb.LongRunningRecognizeRequest{
+		Config: recognitionConfig,
+		Audio: &speechpb.RecognitionAudio{
+			AudioSource: &speechpb.RecognitionAudio_Uri{Uri: audio.Uri},
+		},
+	}
+
+	op, err := speechClient.LongRunningRecognize(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := op.Poll(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				cancelGoogleOperation(speechClient, op.Name())
+			}
+			return nil, err
+		}
+		if op.Done() {
+			return segmentsFromSpeechResults(resp.Results), nil
+		}
+		if metadata, err := op.Metadata(); err == nil && metadata != nil {
+			progress(metadata.ProgressPercent)
+		}
+
+		select {
+		case <-ctx.Done():
+			cancelGoogleOperation(speechClient, op.Name())
+			return nil, ctx.Err()
+		case <-time.After(googlePollInterval):
+		}
+	}
+}
+
+// cancelGoogleOperation stops the long-running recognition nobody waits for any more.
+func cancelGoogleOperation(speechClient *speech.Client, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err := speechClient.LROClient.CancelOperation(ctx, &longrunningpb.CancelOperationRequest{Name: name}); err != nil {
+		fmt.Printf("Can not cancel recognition operation %v: %v\n", name, err)
+	}
+}
+
+// recognizeGoogleInline recognizes short audio synchronously, without uploading it.
+func recognizeGoogleInline(ctx context.Context, speechClient *speech.Client, content []byte, config *RecognitionConfig) ([]Segment, error) {
+	resp, err := speechClient.Recognize(ctx, &speechpb.RecognizeRequest{
+		Config: googleRecognitionConfig(config),
+		Audio: &speechpb.RecognitionAudio{
+			AudioSource: &speechpb.RecognitionAudio_Content{Content: content},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return segmentsFromSpeechResults(resp.Results), nil
+}
+
+// googleStreamLimit restarts streaming recognition before the API ends the stream (about 5 minutes of audio)
+const googleStreamLimit = time.Minute * 4
+
+// googleStreamMaxGap restarts streaming recognition on a gap in the audio, so result offsets map to capture times again
+const googleStreamMaxGap = time.Second
+
+func (r *googleRecognizer) RecognizeStream(ctx context.Context, audio <-chan gst.Chunk, config *RecognitionConfig, onResult func(StreamingResult)) error {
+	speechClient, err := r.getClient()
+	if err != nil {
+		return err
+	}
+
+	var pending *gst.Chunk
+	for {
+		chunk, ok := pending, true
+		if chunk == nil {
+			var next gst.Chunk
+			select {
+			case next, ok = <-audio:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if !ok {
+				return nil
+			}
+			chunk = &next
+		}
+		pending, err = recognizeGoogleStream(ctx, speechClient, *chunk, audio, config, onResult)
+		if err != nil || pending == nil {
+			return err
+		}
+	}
+}
+
+// recognizeGoogleStream runs one streaming recognition starting with the first chunk. It returns the chunk
+// which should start the next stream, or nil when the audio has ended.
+func recognizeGoogleStream(ctx context.Context, speechClient *speech.Client, first gst.Chunk, audio <-chan gst.Chunk, config *RecognitionConfig, onResult func(StreamingResult)) (*gst.Chunk, error) {
+	stream, err := speechClient.StreamingRecognize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = stream.Send(&speechpb.StreamingRecognizeRequest{
+		StreamingRequest: &speechpb.StreamingRecognizeRequest_StreamingConfig{
+			StreamingConfig: &speechpb.StreamingRecognitionConfig{
+				Config:         googleRecognitionConfig(config),
+				InterimResults: true,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// result offsets are relative to the capture time of the first chunk
+	streamStart := first.Time
+	recvDone := make(chan error, 1)
+	go func() {
+		lastFinalEnd := streamStart
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				recvDone <- nil
+				return
+			}
+			if err != nil {
+				recvDone <- err
+				return
+			}
+			for _, result := range resp.Results {
+				if len(result.Alternatives) == 0 {
+					continue
+				}
+				streamingResult := StreamingResult{
+					Transcript:   result.Alternatives[0].Transcript,
+					IsFinal:      result.IsFinal,
+					Stability:    result.Stability,
+					Confidence:   result.Alternatives[0].Confidence,
+					StartTime:    lastFinalEnd,
+					EndTime:      streamStart.Add(result.ResultEndTime.AsDuration()),
+					LanguageCode: result.LanguageCode,
+				}
+				if result.IsFinal {
+					lastFinalEnd = streamingResult.EndTime
+				}
+				onResult(streamingResult)
+			}
+		}
+	}()
+
+	var next *gst.Chunk
+	expected := first.Time
+	chunk, ok := first, true
+	deadline := time.After(googleStreamLimit)
+	restart := false
+sendLoop:
+	for {
+		if restart || chunk.Time.Sub(expected) > googleStreamMaxGap {
+			next = &chunk
+			break
+		}
+		err = stream.Send(&speechpb.StreamingRecognizeRequest{
+			StreamingRequest: &speechpb.StreamingRecognizeRequest_AudioContent{AudioContent: chunk.Data},
+		})
+		if err == io.EOF {
+			// the stream was ended by the API, Recv tells why
+			err = nil
+			next = &chunk
+			break
+		}
+		if err != nil {
+			break
+		}
+		expected = expected.Add(chunk.Duration())
+
+		for received := false; !received; {
+			select {
+			case chunk, ok = <-audio:
+				if !ok {
+					break sendLoop
+				}
+				received = true
+			case <-deadline:
+				// the next chunk starts a new stream
+				restart = true
+				deadline = nil
+			case recvErr := <-recvDone:
+				// the API ends streams after a while without audio, the next chunk starts a new stream
+				if recvErr != nil {
+					fmt.Printf("streaming recognition ended: %v\n", recvErr)
+				}
+				recvDone = nil
+				restart = true
+			case <-ctx.Done():
+				err = ctx.Err()
+				break sendLoop
+			}
+		}
+	}
+
+	if closeErr := stream.CloseSend(); err == nil && recvDone != nil {
+		err = closeErr
+	}
+	if recvDone != nil {
+		if recvErr := <-recvDone; err == nil {
+			err = recvErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
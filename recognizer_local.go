@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	gst "rtp-audio-processor/gstreamer-src"
+	"strings"
+	"time"
+)
+
+// localRecognizer sends audio to a locally running whisper-style transcription server
+// (whisper.cpp server or an OpenAI compatible /v1/audio/transcriptions endpoint).
+type localRecognizer struct {
+	url    string
+	client *http.Client
+}
+
+type localTranscriptionWord struct {
+	Word        string  `json:"word"`
+	Start       float64 `json:"start"`
+	End         float64 `json:"end"`
+	Probability float32 `json:"probability"`
+}
+
+type localTranscriptionSegment struct {
+	Start float64                  `json:"start"`
+	End   float64                  `json:"end"`
+	Text  string                   `json:"text"`
+	Words []localTranscriptionWord `json:"words"`
+}
+
+type localTranscription struct {
+	Text     string                      `json:"text"`
+	Language string                      `json:"language"`
+	Segments []localTranscriptionSegment `json:"segments"`
+	Words    []localTranscriptionWord    `json:"words"`
+}
+
+func newLocalRecognizer(url string) *localRecognizer {
+	return &localRecognizer{url: url, client: &http.Client{}}
+}
+
+// MaxInlineDuration covers whole ring buffers, the audio is sent in the request body anyway.
+func (r *localRecognizer) MaxInlineDuration() time.Duration {
+	return gst.RingBufferDuration
+}
+
+func (r *localRecognizer) Recognize(ctx context.Context, audio *RecognitionAudio, config *RecognitionConfig, _ func(percent int32)) ([]Segment, error) {
+	if r.url == "" {
+		return nil, errors.New("environment variable LOCAL_RECOGNIZER_URL is not set")
+	}
+
+	pcm, err := audio.content(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	fileWriter, err := form.CreateFormFile("file", "audio.wav")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeWavHeader(fileWriter, 1, gst.SampleRate, gst.BytesPerSample*8, len(pcm)); err != nil {
+		return nil, err
+	}
+	if _, err := fileWriter.Write(pcm); err != nil {
+		return nil, err
+	}
+	fields := map[string]string{
+		"response_format":           "verbose_json",
+		"timestamp_granularities[]": "word",
+	}
+	if config.LanguageCode != "" && !config.AutoDetectLanguage && len(config.AlternativeLanguageCodes) == 0 {
+		// whisper detects the language when none is given, and expects ISO 639-1 codes otherwise
+		fields["language"] = strings.ToLower(strings.SplitN(config.LanguageCode, "-", 2)[0])
+	}
+	if config.Model != "" {
+		fields["model"] = config.Model
+	}
+	if len(config.Phrases) > 0 {
+		// whisper has no phrase hints, a prompt mentioning them steers it the same way
+		fields["prompt"] = strings.Join(config.Phrases, ", ")
+	}
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("local recognizer responded %v: %s", resp.Status, message)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return nil, &temporaryError{err}
+		}
+		return nil, err
+	}
+
+	var transcription localTranscription
+	if err := json.NewDecoder(resp.Body).Decode(&transcription); err != nil {
+		return nil, fmt.Errorf("can not decode local recognizer response: %w", err)
+	}
+	return transcription.toSegments(), nil
+}
+
+// whisperLanguages maps the language names reported by whisper to their codes
+var whisperLanguages = map[string]string{
+	"english": "en", "chinese": "zh", "german": "de", "spanish": "es", "russian": "ru", "korean": "ko", "french": "fr",
+	"japanese": "ja", "portuguese": "pt", "turkish": "tr", "polish": "pl", "catalan": "ca", "dutch": "nl",
+	"arabic": "ar", "swedish": "sv", "italian": "it", "indonesian": "id", "hindi": "hi", "finnish": "fi",
+	"vietnamese": "vi", "hebrew": "he", "ukrainian": "uk", "greek": "el", "malay": "ms", "czech": "cs",
+	"romanian": "ro", "danish": "da", "hungarian": "hu", "tamil": "ta", "norwegian": "no", "thai": "th", "urdu": "ur",
+	"croatian": "hr", "bulgarian": "bg", "lithuanian": "lt", "latin": "la", "maori": "mi", "malayalam": "ml",
+	"welsh": "cy", "slovak": "sk", "telugu": "te", "persian": "fa", "latvian": "lv", "bengali": "bn", "serbian": "sr",
+	"azerbaijani": "az", "slovenian": "sl", "kannada": "kn", "estonian": "et", "macedonian": "mk", "breton": "br",
+	"basque": "eu", "icelandic": "is", "armenian": "hy", "nepali": "ne", "mongolian": "mn", "bosnian": "bs",
+	"kazakh": "kk", "albanian": "sq", "swahili": "sw", "galician": "gl", "marathi": "mr", "punjabi": "pa",
+	"sinhala": "si", "khmer": "km", "shona": "sn", "yoruba": "yo", "somali": "so", "afrikaans": "af", "occitan": "oc",
+	"georgian": "ka", "belarusian": "be", "tajik": "tg", "sindhi": "sd", "gujarati": "gu", "amharic": "am",
+	"yiddish": "yi", "lao": "lo", "uzbek": "uz", "faroese": "fo", "haitian creole": "ht", "pashto": "ps",
+	"turkmen": "tk", "nynorsk": "nn", "maltese": "mt", "sanskrit": "sa", "luxembourgish": "lb", "myanmar": "my",
+	"tibetan": "bo", "tagalog": "tl", "malagasy": "mg", "assamese": "as", "tatar": "tt", "hawaiian": "haw",
+	"lingala": "ln", "hausa": "ha", "bashkir": "ba", "javanese": "jv", "sundanese": "su", "cantonese": "yue",
+}
+
+// whisperLanguageCode returns the code of the language reported by whisper, which is a name like "english"
+// (OpenAI compatible servers may report codes already). Unknown languages are left empty.
+func whisperLanguageCode(language string) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if code, ok := whisperLanguages[language]; ok {
+		return code
+	}
+	for _, code := range whisperLanguages {
+		if language == code {
+			return code
+		}
+	}
+	return ""
+}
+
+func secondsToMs(seconds float64) int64 {
+	return int64(seconds * 1000)
+}
+
+func (t *localTranscription) toSegments() []Segment {
+	segments := t.Segments
+	if len(segments) == 0 && t.Text != "" {
+		segments = []localTranscriptionSegment{{Text: t.Text, Words: t.Words}}
+		if len(t.Words) > 0 {
+			segments[0].End = t.Words[len(t.Words)-1].End
+		}
+	}
+
+	results := make([]Segment, 0, len(segments))
+	for _, segment := range segments {
+		words := segment.Words
+		if len(words) == 0 {
+			// OpenAI compatible servers return words for the whole transcription
+			for _, word := range t.Words {
+				if word.Start >= segment.Start && word.Start < segment.End {
+					words = append(words, word)
+				}
+			}
+		}
+
+		result := Segment{
+			StartMs:      secondsToMs(segment.Start),
+			EndMs:        secondsToMs(segment.End),
+			Text:         strings.TrimSpace(segment.Text),
+			LanguageCode: whisperLanguageCode(t.Language),
+			Words:        make([]Word, 0, len(words)),
+		}
+		for _, word := range words {
+			result.Words = append(result.Words, Word{
+				Word:       strings.TrimSpace(word.Word),
+				StartMs:    secondsToMs(word.Start),
+				EndMs:      secondsToMs(word.End),
+				Confidence: word.Probability,
+			})
+		}
+		results = append(results, result)
+	}
+	return results
+}
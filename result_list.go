@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPageSize and maxPageSize bound a page of GET /speech-to-text without requestId
+const defaultPageSize = 50
+const maxPageSize = 500
+
+// ResultList is a page of results, without their transcripts. NextPageToken is set when more results match.
+type ResultList struct {
+	Results       []Result
+	NextPageToken string `json:",omitempty"`
+}
+
+// listResultsHandler lists results newest first, filtered by the optional pipelineId, endpoint, status
+// (comma separated) and from/to (unix ms, when the request was made) params, paged by pageSize and pageToken.
+func listResultsHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	query := r.URL.Query()
+	pipelineId, endpointId := query.Get("pipelineId"), query.Get("endpoint")
+	var statuses map[ResultStatus]bool
+	if hasRequestParam(r, "status") {
+		statuses = make(map[ResultStatus]bool)
+		for _, status := range strings.Split(query.Get("status"), ",") {
+			statuses[ResultStatus(strings.TrimSpace(status))] = true
+		}
+	}
+	var from, to time.Time
+	if hasRequestParam(r, "from") {
+		if from, err = getRequestParamTime(r, "from"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if hasRequestParam(r, "to") {
+		if to, err = getRequestParamTime(r, "to"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	pageSize := defaultPageSize
+	if hasRequestParam(r, "pageSize") {
+		pageSize, err = getRequestParamInt(r, "pageSize")
+		if err != nil || pageSize <= 0 {
+			http.Error(w, "pageSize param error", http.StatusBadRequest)
+			return
+		}
+		if pageSize > maxPageSize {
+			pageSize = maxPageSize
+		}
+	}
+	var after *Result
+	if pageToken := query.Get("pageToken"); pageToken != "" {
+		if after, err = parsePageToken(pageToken); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	list := results.List(func(result *Result) bool {
+		switch {
+		case after != nil && !resultNewer(after, result):
+			return false
+		case pipelineId != "" && result.PipelineId != pipelineId:
+			return false
+		case endpointId != "" && !resultHasEndpoint(result, endpointId):
+			return false
+		case statuses != nil && !statuses[result.Status]:
+			return false
+		case !from.IsZero() && result.Time.Before(from):
+			return false
+		case !to.IsZero() && !result.Time.Before(to):
+			return false
+		}
+		return true
+	})
+
+	page := ResultList{Results: []Result{}}
+	for i := range list {
+		if i == pageSize {
+			last := page.Results[pageSize-1]
+			page.NextPageToken = fmt.Sprintf("%d.%s", last.Time.UnixNano(), last.RequestId)
+			break
+		}
+		result := list[i]
+		result.Segments, result.RecognitionResults, result.Transcript, result.Alerts = nil, nil, nil, nil
+		page.Results = append(page.Results, result)
+	}
+	writeJson(w, page)
+}
+
+func resultHasEndpoint(result *Result, endpointId string) bool {
+	if result.Endpoint == endpointId {
+		return true
+	}
+	for _, id := range result.Endpoints {
+		if id == endpointId {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePageToken reads the time and request id of the last result of the previous page.
+func parsePageToken(token string) (*Result, error) {
+	parts := strings.SplitN(token, ".", 2)
+	unixNano, err := strconv.ParseInt(parts[0], 10, 64)
+	if len(parts) != 2 || err != nil {
+		return nil, fmt.Errorf("pageToken param error")
+	}
+	return &Result{Time: time.Unix(0, unixNano), RequestId: parts[1]}, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// listResults requests GET /speech-to-text with the query.
+func listResults(t *testing.T, query string) ResultList {
+	w := httptest.NewRecorder()
+	speechToTextHandler(w, httptest.NewRequest(http.MethodGet, "/speech-to-text?"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%v: status %v: %v", query, w.Code, w.Body.String())
+	}
+	var list ResultList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+// useResultStore replaces the results by an empty store for the test.
+func useResultStore(t *testing.T) {
+	store, err := newResultStore(time.Hour, 100, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := results
+	t.Cleanup(func() {
+		results = previous
+	})
+	results = store
+}
+
+func TestListResults(t *testing.T) {
+	useResultStore(t)
+	start := time.Unix(1000, 0)
+	created := []*Result{
+		{Time: start, PipelineId: "p1", Endpoint: "e1", Status: StatusDone},
+		{Time: start.Add(time.Second), PipelineId: "p1", Endpoint: "e2", Status: StatusFailed},
+		{Time: start.Add(2 * time.Second), PipelineId: "p2", Endpoints: []string{"e1", "e3"}, Status: StatusDone},
+		{Time: start.Add(3 * time.Second), PipelineId: "p2", Endpoint: "e3", Status: StatusQueued},
+	}
+	requestIds := make([]string, len(created))
+	for i, result := range created {
+		result.Segments = []Segment{{Text: "call me"}}
+		result.Transcript = []TranscriptEntry{{Text: "call me"}}
+		result.Alerts = []AlertEvent{{Transcript: "call me"}}
+		requestIds[i] = results.Create(result).RequestId
+	}
+	ms := func(seconds int) int64 {
+		return start.Add(time.Duration(seconds)*time.Second).UnixNano() / int64(time.Millisecond)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []int // indexes of the created results, newest first
+	}{
+		{"all", "", []int{3, 2, 1, 0}},
+		{"pipeline", "pipelineId=p1", []int{1, 0}},
+		{"endpoint of results and conversations", "endpoint=e1", []int{2, 0}},
+		{"status", "status=done", []int{2, 0}},
+		{"statuses", "status=queued,failed", []int{3, 1}},
+		{"pipeline and status", "pipelineId=p2&status=done", []int{2}},
+		{"from is inclusive", fmt.Sprintf("from=%d", ms(1)), []int{3, 2, 1}},
+		{"to is exclusive", fmt.Sprintf("to=%d", ms(2)), []int{1, 0}},
+		{"from and to", fmt.Sprintf("from=%d&to=%d", ms(1), ms(3)), []int{2, 1}},
+		{"no match", "pipelineId=p3", []int{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			list := listResults(t, test.query)
+			got := make([]string, 0, len(list.Results))
+			for _, result := range list.Results {
+				got = append(got, result.RequestId)
+				if result.Segments != nil || result.Transcript != nil || result.Alerts != nil {
+					t.Errorf("result %v listed with its transcript", result.RequestId)
+				}
+			}
+			want := make([]string, 0, len(test.want))
+			for _, i := range test.want {
+				want = append(want, requestIds[i])
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if list.NextPageToken != "" {
+				t.Errorf("next page token %q of the only page", list.NextPageToken)
+			}
+		})
+	}
+}
+
+func TestListResultsPaging(t *testing.T) {
+	useResultStore(t)
+	start := time.Unix(1000, 0)
+	// results made at the same time are paged by request id
+	times := []time.Time{start, start, start.Add(time.Second), start, start, start.Add(-time.Second), start}
+	for _, created := range times {
+		results.Create(&Result{Time: created, PipelineId: "p1", Status: StatusDone})
+	}
+	all := results.List(func(result *Result) bool { return true })
+
+	var paged []Result
+	query := "pipelineId=p1&pageSize=2"
+	for pages := 1; ; pages++ {
+		list := listResults(t, query)
+		paged = append(paged, list.Results...)
+		if list.NextPageToken == "" {
+			if pages != 4 {
+				t.Errorf("%v pages of 2 for %v results", pages, len(times))
+			}
+			break
+		}
+		if pages == len(times) {
+			t.Fatal("paging does not end")
+		}
+		query = "pipelineId=p1&pageSize=2&pageToken=" + list.NextPageToken
+	}
+	if len(paged) != len(all) {
+		t.Fatalf("paged %v results, want %v", len(paged), len(all))
+	}
+	for i := range all {
+		if paged[i].RequestId != all[i].RequestId {
+			t.Errorf("result %v of the pages is %v, want %v", i, paged[i].RequestId, all[i].RequestId)
+		}
+	}
+}
+
+func TestListResultsBadParams(t *testing.T) {
+	for _, query := range []string{"pageSize=0", "pageSize=x", "pageToken=x", "pageToken=1", "from=x"} {
+		w := httptest.NewRecorder()
+		speechToTextHandler(w, httptest.NewRequest(http.MethodGet, "/speech-to-text?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: status %v, want %v", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
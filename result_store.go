@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resultStore keeps speech-to-text results for ttl, at most maxResults of them (oldest are evicted first).
+// With dir set every result is also persisted as <dir>/<requestId>.json, so results survive restarts.
+// Results are only changed through Update and handed out as copies, so readers never see a half written result.
+type resultStore struct {
+	results    map[string]*Result
+	finished   map[string]chan struct{} // closed once the result reaches a finished status
+	ttl        time.Duration
+	maxResults int
+	dir        string
+	mutex      sync.Mutex
+	// interrupted are the results failed by load, to be delivered once the store is in use
+	interrupted []Result
+}
+
+var results *resultStore
+
+func init() {
+	ttl := time.Hour * 24
+	if value, isEnvSet := os.LookupEnv("RESULTS_TTL"); isEnvSet {
+		var err error
+		ttl, err = time.ParseDuration(value)
+		if err != nil {
+			panic(fmt.Sprintf("environment variable RESULTS_TTL is not a duration: %v", err))
+		}
+	}
+	maxResults := 10000
+	if value, isEnvSet := os.LookupEnv("RESULTS_MAX"); isEnvSet {
+		var err error
+		maxResults, err = strconv.Atoi(value)
+		if err != nil || maxResults <= 0 {
+			panic(fmt.Sprintf("environment variable RESULTS_MAX is not a positive number: %v", value))
+		}
+	}
+
+	var err error
+	results, err = newResultStore(ttl, maxResults, os.Getenv("RESULTS_DIR"))
+	if err != nil {
+		panic(fmt.Sprintf("can not load results: %v", err))
+	}
+	// callers waiting for a callback or a Pub/Sub message get the failure of an interrupted recognition
+	for _, result := range results.interrupted {
+		deliverResultInBackground(result)
+	}
+	results.interrupted = nil
+	go func() {
+		for range time.Tick(time.Minute) {
+			results.expire()
+		}
+	}()
+}
+
+func newResultStore(ttl time.Duration, maxResults int, dir string) (*resultStore, error) {
+	s := &resultStore{
+		results:    make(map[string]*Result),
+		finished:   make(map[string]chan struct{}),
+		ttl:        ttl,
+		maxResults: maxResults,
+		dir:        dir,
+	}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.expire()
+	return s, nil
+}
+
+// load reads persisted results, failing the ones which were still running when the process stopped.
+func (s *resultStore) load() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		result := &Result{}
+		if err := json.Unmarshal(content, result); err != nil {
+			fmt.Printf("skip unreadable result %v: %v\n", path, err)
+			continue
+		}
+		if result.RequestId == "" {
+			result.RequestId = strings.TrimSuffix(filepath.Base(path), ".json")
+		}
+		if result.Segments == nil && result.RecognitionResults != nil {
+			// persisted before results had segments
+			result.Segments = segmentsFromSpeechResults(result.RecognitionResults)
+		}
+		if !result.Status.finished() {
+			result.fail("Recognition interrupted by restart")
+			s.persist(result)
+			s.interrupted = append(s.interrupted, *result)
+		}
+		s.results[result.RequestId] = result
+	}
+	return nil
+}
+
+// Create stores the result under a new unique RequestId and returns a copy of it.
+func (s *resultStore) Create(result *Result) Result {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for {
+		result.RequestId = strconv.FormatUint(rand.Uint64(), 10)
+		if _, ok := s.results[result.RequestId]; !ok {
+			break
+		}
+	}
+	for len(s.results) >= s.maxResults {
+		s.evictOldest()
+	}
+	s.results[result.RequestId] = result
+	if !result.Status.finished() {
+		s.finished[result.RequestId] = make(chan struct{})
+	}
+	s.persist(result)
+	return *result
+}
+
+func (s *resultStore) Get(requestId string) (Result, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result, ok := s.results[requestId]
+	if !ok {
+		return Result{}, false
+	}
+	return *result, true
+}
+
+// List returns copies of the results matching filter, newest first.
+func (s *resultStore) List(filter func(result *Result) bool) []Result {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var list []Result
+	for _, result := range s.results {
+		if filter(result) {
+			list = append(list, *result)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return resultNewer(&list[i], &list[j])
+	})
+	return list
+}
+
+func resultNewer(a, b *Result) bool {
+	if !a.Time.Equal(b.Time) {
+		return a.Time.After(b.Time)
+	}
+	return a.RequestId > b.RequestId
+}
+
+// Update applies update to the stored result and persists it. Slices in the result must be
+// replaced by update rather than changed in place, as copies handed out earlier share them.
+func (s *resultStore) Update(requestId string, update func(result *Result)) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result, ok := s.results[requestId]
+	if !ok {
+		return false
+	}
+	update(result)
+	if result.Status.finished() {
+		s.notifyFinished(result.RequestId)
+	}
+	s.persist(result)
+	return true
+}
+
+// Wait returns the result once it is finished or ctx is done, whichever comes first.
+func (s *resultStore) Wait(ctx context.Context, requestId string) (Result, bool) {
+	s.mutex.Lock()
+	finished, ok := s.finished[requestId]
+	s.mutex.Unlock()
+
+	if ok {
+		select {
+		case <-finished:
+		case <-ctx.Done():
+		}
+	}
+	return s.Get(requestId)
+}
+
+func (s *resultStore) notifyFinished(requestId string) {
+	if finished, ok := s.finished[requestId]; ok {
+		close(finished)
+		delete(s.finished, requestId)
+	}
+}
+
+func (s *resultStore) expire() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for requestId, result := range s.results {
+		if time.Since(result.Time) > s.ttl {
+			s.delete(requestId)
+		}
+	}
+}
+
+func (s *resultStore) evictOldest() {
+	var oldest *Result
+	for _, result := range s.results {
+		if oldest == nil || result.Time.Before(oldest.Time) {
+			oldest = result
+		}
+	}
+	if oldest != nil {
+		s.delete(oldest.RequestId)
+	}
+}
+
+func (s *resultStore) delete(requestId string) {
+	delete(s.results, requestId)
+	s.notifyFinished(requestId)
+	if s.dir == "" {
+		return
+	}
+	if err := os.Remove(s.resultPath(requestId)); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("can not remove result %v: %v\n", requestId, err)
+	}
+}
+
+func (s *resultStore) resultPath(requestId string) string {
+	return filepath.Join(s.dir, requestId+".json")
+}
+
+// persist writes the result through a temporary file, so a crash never leaves a truncated result behind.
+func (s *resultStore) persist(result *Result) {
+	if s.dir == "" {
+		return
+	}
+	content, err := json.Marshal(result)
+	if err != nil {
+		fmt.Printf("can not marshal result %v: %v\n", result.RequestId, err)
+		return
+	}
+	path := s.resultPath(result.RequestId)
+	if err := os.WriteFile(path+".tmp", content, 0o644); err != nil {
+		fmt.Printf("can not persist result %v: %v\n", result.RequestId, err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		fmt.Printf("can not persist result %v: %v\n", result.RequestId, err)
+	}
+}
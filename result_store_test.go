@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResultStoreEviction(t *testing.T) {
+	tests := []struct {
+		name       string
+		ttl        time.Duration
+		maxResults int
+		ages       []time.Duration // of the created results, in creation order
+		kept       []int           // indexes of the results left after expire
+	}{
+		{"all fresh", time.Hour, 10, []time.Duration{0, time.Minute, time.Second}, []int{0, 1, 2}},
+		{"ttl expired", time.Hour, 10, []time.Duration{2 * time.Hour, time.Minute, time.Hour + time.Second}, []int{1}},
+		{"max evicts oldest", time.Hour, 2, []time.Duration{time.Minute, 3 * time.Minute, 2 * time.Minute}, []int{0, 2}},
+		{"max and ttl", time.Hour, 2, []time.Duration{time.Minute, 2 * time.Hour, 2 * time.Minute}, []int{0, 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, err := newResultStore(test.ttl, test.maxResults, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			requestIds := make([]string, len(test.ages))
+			for i, age := range test.ages {
+				requestIds[i] = store.Create(&Result{Time: time.Now().Add(-age), Status: StatusDone}).RequestId
+			}
+			store.expire()
+
+			kept := make(map[int]bool)
+			for _, i := range test.kept {
+				kept[i] = true
+			}
+			for i, requestId := range requestIds {
+				_, ok := store.Get(requestId)
+				if ok != kept[i] {
+					t.Errorf("result %v kept = %v, want %v", i, ok, kept[i])
+				}
+				_, err := os.Stat(store.resultPath(requestId))
+				if persisted := err == nil; persisted != kept[i] {
+					t.Errorf("result %v persisted = %v, want %v", i, persisted, kept[i])
+				}
+			}
+		})
+	}
+}
+
+func TestResultStorePersistence(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newResultStore(time.Hour, 10, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := store.Create(&Result{Time: time.Now(), Status: StatusQueued, PipelineId: "p1"})
+	running := store.Create(&Result{Time: time.Now(), Status: StatusQueued, PipelineId: "p2"})
+	store.Update(done.RequestId, func(result *Result) {
+		result.Segments = []Segment{{Text: "hello"}}
+		result.setStatus(StatusDone)
+	})
+	store.Update(running.RequestId, func(result *Result) {
+		result.setStatus(StatusRecognizing)
+	})
+	if err := os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	temporary, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if len(temporary) > 0 {
+		t.Errorf("temporary files left behind: %v", temporary)
+	}
+
+	loaded, err := newResultStore(time.Hour, 10, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		requestId string
+		status    ResultStatus
+		error     string
+		segments  int
+	}{
+		{done.RequestId, StatusDone, "", 1},
+		{running.RequestId, StatusFailed, "Recognition interrupted by restart", 0},
+	}
+	for _, test := range tests {
+		result, ok := loaded.Get(test.requestId)
+		if !ok {
+			t.Fatalf("result %v not loaded", test.requestId)
+		}
+		if result.Status != test.status || result.Error != test.error || len(result.Segments) != test.segments {
+			t.Errorf("loaded result %v: status %v, error %q, %v segments; want %v, %q, %v",
+				test.requestId, result.Status, result.Error, len(result.Segments), test.status, test.error, test.segments)
+		}
+	}
+	if _, ok := loaded.Get("broken"); ok {
+		t.Error("unreadable result loaded")
+	}
+
+	// the failure of the interrupted result is persisted too
+	reloaded, err := newResultStore(time.Hour, 10, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := reloaded.Get(running.RequestId); result.Status != StatusFailed {
+		t.Errorf("reloaded interrupted result status %v, want %v", result.Status, StatusFailed)
+	}
+}
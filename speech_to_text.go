@@ -1,222 +1,492 @@
 package main
 
 import (
-	speech "cloud.google.com/go/speech/apiv1"
-	"cloud.google.com/go/storage"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
-	"math/rand"
+	"log"
 	"net/http"
-	"os"
 	gst "rtp-audio-processor/gstreamer-src"
-	"strconv"
-	"sync"
 	"time"
 )
 
-type Result struct {
-	RequestId          string
-	Time               time.Time
-	PipelineId         string
-	Endpoint           string
-	LanguageCode       string
-	AudioUri           string
-	RecognitionResults []*speechpb.SpeechRecognitionResult
-	Error              string
-}
+type ResultStatus string
 
-var results map[string]*Result
-var resultsMutex sync.RWMutex
-var audioBucket string
-
-func init() {
-	results = make(map[string]*Result)
+const (
+	StatusQueued      ResultStatus = "queued"
+	StatusExporting   ResultStatus = "exporting"
+	StatusUploading   ResultStatus = "uploading"
+	StatusRecognizing ResultStatus = "recognizing"
+	StatusDone        ResultStatus = "done"
+	StatusFailed      ResultStatus = "failed"
+	StatusCancelled   ResultStatus = "cancelled"
+)
 
-	var isEnvSet bool
-	audioBucket, isEnvSet = os.LookupEnv("AUDIO_BUCKET")
-	if !isEnvSet {
-		panic("environment variable AUDIO_BUCKET not set")
-	}
+func (s ResultStatus) finished() bool {
+	return s == StatusDone || s == StatusFailed || s == StatusCancelled
 }
 
-func recognize(ctx context.Context, audioUri, languageCode string) (*speechpb.LongRunningRecognizeResponse, error) {
-	speechClient, err := speech.NewClient(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("can not create speech client: %w", err)
-	}
-	defer func(speechClient *speech.Client) {
-		err := speechClient.Close()
-		if err != nil {
-			fmt.Printf("Can not close speech client: %v", err.Error())
-		}
-	}(speechClient)
-
-	req := &speechpb.LongRunningRecognizeRequest{
-		Config: &speechpb.RecognitionConfig{
-			Encoding:          speechpb.RecognitionConfig_LINEAR16,
-			SampleRateHertz:   48000,
-			LanguageCode:      languageCode,
-			AudioChannelCount: 1,
-		},
-		Audio: &speechpb.RecognitionAudio{
-			AudioSource: &speechpb.RecognitionAudio_Uri{Uri: audioUri},
-		},
-	}
-
-	op, err := speechClient.LongRunningRecognize(ctx, req)
-	if err != nil {
-		return nil, err
-	}
-	return op.Wait(ctx)
+type Result struct {
+	RequestId                string
+	Time                     time.Time
+	Status                   ResultStatus
+	Progress                 int32
+	Retries                  int        `json:",omitempty"`
+	Redactions               int        `json:",omitempty"`
+	QueuedTime               *time.Time `json:",omitempty"`
+	ExportingTime            *time.Time `json:",omitempty"`
+	UploadingTime            *time.Time `json:",omitempty"`
+	RecognizingTime          *time.Time `json:",omitempty"`
+	FinishedTime             *time.Time `json:",omitempty"`
+	PipelineId               string
+	BookmarkId               string
+	Endpoint                 string
+	LanguageCode             string
+	AlternativeLanguageCodes []string `json:",omitempty"`
+	DetectedLanguageCode     string   `json:",omitempty"`
+	Recognizer               string
+	AudioUri                 string
+	Segments                 []Segment `json:",omitempty"`
+	// RecognitionResults is the deprecated Google shape of Segments, filled in for legacyResults requests
+	RecognitionResults []*speechpb.SpeechRecognitionResult `json:",omitempty"`
+	Endpoints          []string                            `json:",omitempty"`
+	From               *time.Time                          `json:",omitempty"`
+	To                 *time.Time                          `json:",omitempty"`
+	AudioUris          map[string]string                   `json:",omitempty"`
+	// TemporaryAudioUris are uploads for the recognizer which are not deleted yet, deleted again on restart
+	TemporaryAudioUris  []string          `json:",omitempty"`
+	TemporaryAudioError string            `json:",omitempty"`
+	Transcript          []TranscriptEntry `json:",omitempty"`
+	Alerts              []AlertEvent      `json:",omitempty"`
+	Error               string
+	CallbackUrl         string `json:",omitempty"`
+	PubsubTopic         string `json:",omitempty"`
+	CallbackError       string `json:",omitempty"`
 }
 
-func saveToCloudStorage(ctx context.Context, bucketName, objectName string, objectContent []byte) (string, error) {
-	storageClient, err := storage.NewClient(ctx)
-	if err != nil {
-		return "", fmt.Errorf("can not create storage client: %w", err)
+// setStatus moves the result to status, recording when the phase started.
+func (r *Result) setStatus(status ResultStatus) {
+	now := time.Now()
+	r.Status = status
+	switch status {
+	case StatusQueued:
+		r.QueuedTime = &now
+	case StatusExporting:
+		r.ExportingTime = &now
+	case StatusUploading:
+		r.UploadingTime = &now
+	case StatusRecognizing:
+		r.RecognizingTime = &now
+	case StatusDone:
+		r.Progress = 100
+		r.FinishedTime = &now
+	case StatusFailed, StatusCancelled:
+		r.FinishedTime = &now
 	}
-	defer func(storageClient *storage.Client) {
-		err := storageClient.Close()
-		if err != nil {
-			fmt.Printf("Can not close storage client: %v", err.Error())
-		}
-	}(storageClient)
-
-	object := storageClient.Bucket(bucketName).Object(objectName)
-	objectWriter := object.NewWriter(ctx)
+}
 
-	doneChan := make(chan struct{})
-	errChan := make(chan error)
-	go func() {
-		_, err = objectWriter.Write(objectContent)
-		if err != nil {
-			errChan <- err
-			return
-		}
-		err = objectWriter.Close()
-		if err != nil {
-			errChan <- err
-			return
-		}
-		close(doneChan)
-	}()
-	select {
-	case <-ctx.Done():
-		return "", ctx.Err()
-	case err := <-errChan:
-		return "", err
-	case <-doneChan:
-		return fmt.Sprintf("gs://%v/%v", bucketName, objectName), nil
-	}
+// fail moves the result to StatusFailed with the error message.
+func (r *Result) fail(message string) {
+	r.Error = message
+	r.setStatus(StatusFailed)
 }
 
+// maxResultWait caps the wait param of GET /speech-to-text
+const maxResultWait = time.Minute * 5
+
 func speechToTextHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
+		if !hasRequestParam(r, "requestId") {
+			listResultsHandler(w, r)
+			return
+		}
 		requestId, err := getRequestParam(r, "requestId")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		result := getRecognitionResult(requestId)
+		format := "json"
+		if hasRequestParam(r, "format") {
+			format, err = getRequestParam(r, "format")
+			if err == nil && !resultFormats[format] {
+				err = fmt.Errorf("format param error, unknown format %v", format)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var wait time.Duration
+		if hasRequestParam(r, "wait") {
+			wait, err = getRequestParamDuration(r, "wait")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if wait > maxResultWait {
+				wait = maxResultWait
+			}
+		}
+
+		waitCtx, cancel := context.WithTimeout(r.Context(), wait)
+		result, ok := results.Wait(waitCtx, requestId)
+		cancel()
+		if !ok {
+			http.Error(w, "Result not found", http.StatusNotFound)
+			return
+		}
+		if format != "json" {
+			writeResultFormat(result, format, w)
+			return
+		}
 		marshalResult(result, w)
 	case http.MethodPost:
-		pipelineId, err := getRequestParam(r, "pipelineId")
+		request, err := parseRecognitionRequest(r)
+		if err == nil {
+			request.endpointId, err = getRequestParam(r, "endpoint")
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		endpoint, err := getRequestParam(r, "endpoint")
+
+		result, err := postRecognitionRequest(request)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), recognitionErrorCode(err))
 			return
 		}
-		languageCode, err := getRequestParam(r, "languageCode")
+		marshalResult(result, w)
+	case http.MethodDelete:
+		requestId, err := getRequestParam(r, "requestId")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-
-		result, err := postRecognitionRequest(r.Context(), pipelineId, endpoint, languageCode)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("CancelRecognition(requestId=%s)\n", requestId)
+		if !cancelRecognition(requestId) {
+			if _, ok := results.Get(requestId); ok {
+				http.Error(w, "Result is already finished", http.StatusConflict)
+			} else {
+				http.Error(w, "Result not found", http.StatusNotFound)
+			}
 			return
 		}
-		marshalResult(result, w)
+		fmt.Fprintf(w, "OK")
 	default:
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func getRecognitionResult(requestId string) *Result {
-	resultsMutex.RLock()
-	defer resultsMutex.RUnlock()
-
-	if result, ok := results[requestId]; ok {
-		return result
-	}
-	return nil
+// recognitionRequest is a parsed POST /speech-to-text or /speech-to-text/conversation request.
+type recognitionRequest struct {
+	pipelineId     string
+	bookmarkId     string
+	endpointId     string
+	endpointIds    []string // of a conversation
+	from, to       time.Time
+	recognizerName string
+	recognizer     Recognizer
+	config         *RecognitionConfig
+	callbackUrl    string
+	pubsubTopic    string
+	keepAudio      bool // upload audio recognized inline too
+	legacyResults  bool // fill in RecognitionResults
+	trimSilence    bool // shorten silences before recognition
+	redactPii      bool // mask emails, phone and card numbers in the results
+	bleepAudio     bool // bleep redacted PII in stored audio, implies redactPii
 }
 
-func postRecognitionRequest(ctx context.Context, pipelineId, endpointId, languageCode string) (*Result, error) {
-	exportCtx, exportCancel := context.WithTimeout(ctx, time.Second*5)
-	defer exportCancel()
-	pcmBuf, err := gst.ExportPipeline(exportCtx, pipelineId, endpointId)
+// parseRecognitionRequest reads pipelineId or bookmarkId, the recognition config params and the optional
+// recognizer, callbackUrl, pubsubTopic, keepAudio, legacyResults, trimSilence, redactPii and bleepAudio params.
+func parseRecognitionRequest(r *http.Request) (*recognitionRequest, error) {
+	request := &recognitionRequest{}
+	var err error
+	if hasRequestParam(r, "bookmarkId") {
+		request.bookmarkId, err = getRequestParam(r, "bookmarkId")
+	} else {
+		request.pipelineId, err = getRequestParam(r, "pipelineId")
+	}
 	if err != nil {
-		return nil, fmt.Errorf("export pipeline error: %w", err)
+		return nil, err
+	}
+	request.config, err = parseRecognitionConfig(r)
+	if err != nil {
+		return nil, err
 	}
 
-	resultsMutex.Lock()
+	request.recognizerName = defaultRecognizer
+	if hasRequestParam(r, "recognizer") {
+		request.recognizerName, err = getRequestParam(r, "recognizer")
+		if err != nil {
+			return nil, err
+		}
+	}
+	request.recognizer, err = getRecognizer(request.recognizerName)
+	if err != nil {
+		return nil, err
+	}
 
-	var requestId string
-	for {
-		requestId = strconv.FormatUint(rand.Uint64(), 10)
-		if _, ok := results[requestId]; !ok {
-			break
+	if hasRequestParam(r, "callbackUrl") {
+		request.callbackUrl, err = getRequestParam(r, "callbackUrl")
+		if err != nil {
+			return nil, err
+		}
+		if err := validateCallbackUrl(request.callbackUrl); err != nil {
+			return nil, err
+		}
+	}
+	if hasRequestParam(r, "pubsubTopic") {
+		request.pubsubTopic, err = getRequestParam(r, "pubsubTopic")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if hasRequestParam(r, "keepAudio") {
+		request.keepAudio, err = getRequestParamBool(r, "keepAudio")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if hasRequestParam(r, "legacyResults") {
+		request.legacyResults, err = getRequestParamBool(r, "legacyResults")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if hasRequestParam(r, "trimSilence") {
+		request.trimSilence, err = getRequestParamBool(r, "trimSilence")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if hasRequestParam(r, "redactPii") {
+		request.redactPii, err = getRequestParamBool(r, "redactPii")
+		if err != nil {
+			return nil, err
 		}
 	}
-	result := &Result{
-		RequestId:    requestId,
-		Time:         time.Now(),
-		PipelineId:   pipelineId,
-		Endpoint:     endpointId,
-		LanguageCode: languageCode,
+	if hasRequestParam(r, "bleepAudio") {
+		request.bleepAudio, err = getRequestParamBool(r, "bleepAudio")
+		if err != nil {
+			return nil, err
+		}
+		request.redactPii = request.redactPii || request.bleepAudio
 	}
+	return request, nil
+}
 
-	results[requestId] = result
-	resultsMutex.Unlock()
+// exportAudio exports the endpoint audio from the pipeline ring buffer or from the bookmark clip when bookmarkId is set.
+func exportAudio(ctx context.Context, pipelineId, bookmarkId, endpointId string) (string, *gst.ExportReader, error) {
+	if bookmarkId == "" {
+		pcmReader, err := gst.ExportPipeline(ctx, pipelineId, endpointId)
+		return pipelineId, pcmReader, err
+	}
+	bookmark, err := gst.GetBookmark(bookmarkId)
+	if err != nil {
+		return "", nil, err
+	}
+	pcmReader, err := gst.ExportBookmark(bookmarkId, endpointId)
+	return bookmark.PipelineId, pcmReader, err
+}
 
-	go func() {
-		storeCtx, storeCancel := context.WithTimeout(context.Background(), time.Minute*5)
+func postRecognitionRequest(request *recognitionRequest) (Result, error) {
+	if err := recognitions.reserve(); err != nil {
+		return Result{}, err
+	}
+	queuedTime := time.Now()
+	// the export only ends with the job, which may wait in the queue for long or be cancelled
+	jobCtx, jobCancel := context.WithCancel(context.Background())
+	pipelineId, pcmReader, err := exportAudio(jobCtx, request.pipelineId, request.bookmarkId, request.endpointId)
+	if err != nil {
+		jobCancel()
+		recognitions.release()
+		return Result{}, fmt.Errorf("export pipeline error: %w", err)
+	}
+
+	result := results.Create(&Result{
+		Time:                     queuedTime,
+		Status:                   StatusQueued,
+		QueuedTime:               &queuedTime,
+		PipelineId:               pipelineId,
+		BookmarkId:               request.bookmarkId,
+		Endpoint:                 request.endpointId,
+		LanguageCode:             request.config.LanguageCode,
+		AlternativeLanguageCodes: request.config.AlternativeLanguageCodes,
+		Recognizer:               request.recognizerName,
+		CallbackUrl:              request.callbackUrl,
+		PubsubTopic:              request.pubsubTopic,
+	})
+	requestId := result.RequestId
+
+	recognitions.submit(requestId, jobCancel, func() {
+		defer pcmReader.Close()
+		if err := recognitions.acquire(jobCtx); err != nil {
+			finishRecognition(requestId, func(result *Result) {
+				result.fail(fmt.Sprintf("Recognition error: %v", err))
+			})
+			return
+		}
+		defer recognitions.vacate()
+		results.Update(requestId, func(result *Result) {
+			result.setStatus(StatusExporting)
+		})
+		storeCtx, storeCancel := context.WithTimeout(jobCtx, time.Minute*5)
 		defer storeCancel()
-		audioUri, err := saveToCloudStorage(storeCtx, audioBucket, fmt.Sprintf("r%v-p%v-e%v.pcm", requestId, pipelineId, endpointId), pcmBuf.Bytes())
+		name := fmt.Sprintf("r%v-p%v-e%v", requestId, pipelineId, request.endpointId)
+		audio, err := prepareAudio(storeCtx, requestId, request, name, pcmReader, func() {
+			results.Update(requestId, func(result *Result) {
+				result.setStatus(StatusUploading)
+			})
+		})
 		if err != nil {
-			result.Error = fmt.Sprintf("Save audio to cloud storage error: %v", err.Error())
+			finishRecognition(requestId, func(result *Result) {
+				result.fail(err.Error())
+			})
 			return
 		}
-		result.AudioUri = audioUri
-
-		recognizeCtx, recognizeCancel := context.WithTimeout(context.Background(), time.Minute*30)
-		defer recognizeCancel()
-		resp, err := recognize(recognizeCtx, audioUri, languageCode)
-		if err != nil {
-			result.Error = fmt.Sprintf("Recognition error: %v", err)
+		defer audio.release()
+		if audio.spool.size == 0 {
+			// no audio of the endpoint in the window, nothing to recognize
+			finishRecognition(requestId, func(result *Result) {
+				result.AudioUri = audio.keptUri
+				result.setStatus(StatusDone)
+			})
 			return
 		}
-		result.RecognitionResults = resp.Results
-	}()
+		results.Update(requestId, func(result *Result) {
+			result.AudioUri = audio.keptUri
+			result.setStatus(StatusRecognizing)
+		})
+
+		segments, err := recognize(jobCtx, requestId, request, name, audio, func(percent int32) {
+			results.Update(requestId, func(result *Result) {
+				result.Progress = percent
+			})
+		})
+		var alerts []AlertEvent
+		if err == nil {
+			alerts = segmentAlerts(requestId, pipelineId, request.endpointId, request.bookmarkId, audio.keptUri, segments, pcmReader.Timeline())
+		}
+		// the result reports a temporary upload which can not be deleted
+		audio.release()
+		finishRecognition(requestId, func(result *Result) {
+			// audio with PII is only stored bleeped, after recognition
+			result.AudioUri = audio.keptUri
+			if err != nil {
+				result.fail(fmt.Sprintf("Recognition error: %v", err))
+				return
+			}
+			for i := range segments {
+				segments[i].Endpoint = request.endpointId
+			}
+			result.Segments = segments
+			result.Alerts = alerts
+			if request.legacyResults {
+				result.RecognitionResults = speechResults(segments)
+			}
+			result.DetectedLanguageCode = detectedLanguage(segments)
+			result.setStatus(StatusDone)
+		})
+		publishAlerts(alerts)
+	}, func() {
+		pcmReader.Close()
+	})
 	return result, nil
 }
 
-func marshalResult(result *Result, w http.ResponseWriter) {
-	if result == nil {
-		http.Error(w, "Result not found", http.StatusNotFound)
-		return
+// recognize runs the recognizer, retrying retryable errors, maps offsets into trimmed audio back to the export,
+// and redacts PII when the request asks to redactPii.
+func recognize(ctx context.Context, requestId string, request *recognitionRequest, name string, audio *RecognitionAudio, progress func(percent int32)) ([]Segment, error) {
+	var segments []Segment
+	err := retryRecognition(ctx, requestId, func() error {
+		recognizeCtx, recognizeCancel := context.WithTimeout(ctx, time.Minute*30)
+		defer recognizeCancel()
+		var err error
+		segments, err = request.recognizer.Recognize(recognizeCtx, audio, request.config, progress)
+		if err != nil && recognizeCtx.Err() != nil {
+			// timed out or cancelled, whatever error the recognizer made of it
+			return fmt.Errorf("%v: %w", err, recognizeCtx.Err())
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if audio.trim != nil {
+		audio.trim.restore(segments)
+	}
+	if request.redactPii {
+		redactions, bleeps := redactPii(segments)
+		results.Update(requestId, func(result *Result) {
+			result.Redactions += redactions
+		})
+		storeCtx, storeCancel := context.WithTimeout(ctx, time.Minute*5)
+		defer storeCancel()
+		if err := keepBleepedAudio(storeCtx, requestId, request, name, audio, bleeps); err != nil {
+			return nil, err
+		}
 	}
+	return segments, nil
+}
+
+// recognitionErrorCode is 429 when the recognition queue is full, 503 when it is closed by shutdown,
+// or the code of the export error.
+func recognitionErrorCode(err error) int {
+	if errors.Is(err, errRecognitionQueueFull) {
+		return http.StatusTooManyRequests
+	}
+	if errors.Is(err, errRecognitionQueueClosed) {
+		return http.StatusServiceUnavailable
+	}
+	if errors.Is(err, errEmptyWindow) || errors.Is(err, errWindowNotRetained) {
+		return http.StatusBadRequest
+	}
+	return exportErrorCode(errors.Unwrap(err))
+}
+
+// cancelRecognition cancels the job of the request, false when there is no such job (any more).
+// A queued job is finished as cancelled right away, a running one once it stops.
+func cancelRecognition(requestId string) bool {
+	queued, ok := recognitions.cancel(requestId)
+	if queued {
+		finishRecognition(requestId, func(result *Result) {
+			result.fail("Recognition cancelled")
+		})
+	}
+	return ok
+}
+
+// interruptRecognition fails the result of a job dropped from the queue by shutdown.
+func interruptRecognition(requestId string) {
+	finishRecognition(requestId, func(result *Result) {
+		result.fail("Recognition interrupted by shutdown")
+	})
+}
+
+// finishRecognition applies the final update to the result and delivers it to the requested callbacks.
+func finishRecognition(requestId string, update func(result *Result)) {
+	cancelled, interrupted := recognitions.end(requestId)
+	results.Update(requestId, func(result *Result) {
+		update(result)
+		if cancelled && result.Status == StatusFailed {
+			result.Error = "Recognition cancelled"
+			result.setStatus(StatusCancelled)
+		} else if interrupted && result.Status == StatusFailed {
+			result.Error = "Recognition interrupted by shutdown"
+		}
+	})
+	if result, ok := results.Get(requestId); ok {
+		recognitions.finished(result.Status)
+		deliverResultInBackground(result)
+	}
+}
 
+func marshalResult(result Result, w http.ResponseWriter) {
 	resultBytes, err := json.Marshal(result)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Result marshal error: %v", err.Error()), http.StatusInternalServerError)
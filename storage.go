@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	gst "rtp-audio-processor/gstreamer-src"
+	"strings"
+	"time"
+)
+
+// AudioStorage stores exported audio so recognizers can fetch it by uri.
+type AudioStorage interface {
+	// Save stores content as the named object and returns its uri (gs://, s3:// or file://).
+	Save(ctx context.Context, name string, content io.Reader) (string, error)
+	// Open reads back an object stored by Save.
+	Open(ctx context.Context, uri string) (io.ReadCloser, error)
+	// Delete removes an object stored by Save, an object which is gone already too.
+	Delete(ctx context.Context, uri string) error
+}
+
+// audioStorage is selected by the STORAGE environment variable (gcs, s3 or local; gcs by default).
+// Its bucket needs a lifecycle rule for the temporary *-recognized.* uploads, see the README.
+var audioStorage AudioStorage
+
+// audioStorageError explains why audioStorage is not configured, reported on recognition requests.
+var audioStorageError error
+
+func init() {
+	storageName := "gcs"
+	if name, isEnvSet := os.LookupEnv("STORAGE"); isEnvSet {
+		storageName = name
+	}
+
+	switch storageName {
+	case "gcs":
+		if bucket := os.Getenv("AUDIO_BUCKET"); bucket != "" {
+			audioStorage = newGcsStorage(bucket)
+		} else {
+			audioStorageError = fmt.Errorf("environment variable AUDIO_BUCKET is not set")
+		}
+	case "s3":
+		s3Storage, err := newS3StorageFromEnv()
+		if err != nil {
+			panic(fmt.Sprintf("can not configure s3 storage: %v", err))
+		}
+		audioStorage = s3Storage
+	case "local":
+		dir := os.Getenv("LOCAL_STORAGE_DIR")
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		localStorage, err := newLocalStorage(dir)
+		if err != nil {
+			panic(fmt.Sprintf("can not configure local storage: %v", err))
+		}
+		audioStorage = localStorage
+	default:
+		panic(fmt.Sprintf("environment variable STORAGE has unknown value %v", storageName))
+	}
+}
+
+// readStoredAudio reads back audio saved to audioStorage, for recognizers which need the content.
+func readStoredAudio(ctx context.Context, uri string) ([]byte, error) {
+	if audioStorage == nil {
+		return nil, audioStorageError
+	}
+	reader, err := audioStorage.Open(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// prepareAudio reads the exported audio, shortening its silences when the request asks to trimSilence.
+// The audio is kept inline when it is short enough for the recognizer, and uploaded to the storage
+// (as name with the extension of the upload encoding) when it is longer or when the request asks to keepAudio.
+// Stored audio is always the exported one, so it matches the offsets of the results: trimmed audio
+// too long to be inline is uploaded as a temporary object for the recognizer, deleted on release.
+// Requests which bleepAudio store their audio only after recognition, by keepBleepedAudio, and upload
+// it for the recognizer as a temporary object too.
+// onUpload is called before uploading.
+// Only inline audio is kept in memory, longer audio is spooled to a temporary file for upload retries
+// until the audio is released.
+func prepareAudio(ctx context.Context, requestId string, request *recognitionRequest, name string, pcmReader io.Reader, onUpload func()) (*RecognitionAudio, error) {
+	limit := int64(request.recognizer.MaxInlineDuration()*gst.SampleRate/time.Second) * gst.BytesPerSample
+	audio := &RecognitionAudio{spool: newAudioSpool(limit), requestId: requestId}
+	var err error
+	if request.trimSilence {
+		trimmer := newSilenceTrimmer(audio.spool)
+		var export io.Writer = trimmer
+		if request.keepAudio {
+			audio.exported = newAudioSpool(limit)
+			export = io.MultiWriter(trimmer, audio.exported)
+		}
+		if _, err = io.Copy(export, pcmReader); err == nil {
+			err = trimmer.Close()
+		}
+		audio.trim = trimmer.trim
+	} else {
+		_, err = io.Copy(audio.spool, pcmReader)
+	}
+	if err != nil {
+		audio.release()
+		return nil, fmt.Errorf("export audio error: %w", err)
+	}
+	if request.trimSilence {
+		fmt.Printf("request %v trimmed %v of silence\n", requestId, audio.trim.removed)
+	}
+
+	inline := audio.spool.inMemory()
+	if inline {
+		audio.Inline, audio.Content = true, audio.spool.bytes()
+	}
+	// audio too long to be inline is stored too, unless only its trimmed version was spooled
+	audio.keep = request.keepAudio || (!inline && audio.trim == nil)
+	keepNow := audio.keep && !request.bleepAudio
+	if inline && !keepNow {
+		return audio, nil
+	}
+
+	onUpload()
+	if keepNow {
+		exported := audio.exportedSpool()
+		if audio.keptUri, err = uploadAudio(ctx, requestId, name, exported.open); err != nil {
+			audio.release()
+			return nil, err
+		}
+	}
+	if inline {
+		return audio, nil
+	}
+	if audio.keptUri != "" && audio.trim == nil {
+		audio.Uri = audio.keptUri
+	} else {
+		// trimmed audio, or audio with PII to be bleeped
+		audio.temporary = true
+		if audio.Uri, err = uploadAudio(ctx, requestId, name+"-recognized", audio.spool.open); err != nil {
+			audio.release()
+			return nil, err
+		}
+		results.Update(requestId, func(result *Result) {
+			result.TemporaryAudioUris = append(append([]string(nil), result.TemporaryAudioUris...), audio.Uri)
+		})
+	}
+	audio.Encoding, audio.SampleRate = uploadEncoding, uploadSampleRate
+	return audio, nil
+}
+
+// deleteTemporaryAudio deletes a temporary upload of the request. The upload stays in the TemporaryAudioUris
+// of the result, with the TemporaryAudioError, until it is deleted.
+func deleteTemporaryAudio(ctx context.Context, requestId, uri string) {
+	err := audioStorage.Delete(ctx, uri)
+	if err != nil {
+		fmt.Printf("can not delete temporary audio %v: %v\n", uri, err)
+	}
+	results.Update(requestId, func(result *Result) {
+		if err != nil {
+			result.TemporaryAudioError = fmt.Sprintf("can not delete temporary audio %v: %v", uri, err)
+			return
+		}
+		var uris []string
+		for _, temporaryUri := range result.TemporaryAudioUris {
+			if temporaryUri != uri {
+				uris = append(uris, temporaryUri)
+			}
+		}
+		result.TemporaryAudioUris = uris
+		if len(uris) == 0 {
+			result.TemporaryAudioError = ""
+		}
+	})
+}
+
+// deleteLeftTemporaryAudio deletes the temporary uploads which stored results still have, as the process stopped
+// or the storage failed before they were deleted.
+func deleteLeftTemporaryAudio() {
+	if audioStorage == nil {
+		return
+	}
+	left := results.List(func(result *Result) bool {
+		return len(result.TemporaryAudioUris) > 0
+	})
+	for _, result := range left {
+		for _, uri := range result.TemporaryAudioUris {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			deleteTemporaryAudio(ctx, result.RequestId, uri)
+			cancel()
+		}
+	}
+}
+
+// uploadAudio encodes and saves 48kHz LINEAR16 audio as name with the extension of the upload
+// encoding, streaming the encoded audio to the storage. Every attempt reads the audio from a new reader of pcm.
+func uploadAudio(ctx context.Context, requestId, name string, pcm func() io.Reader) (string, error) {
+	var uri string
+	err := retryRecognition(ctx, requestId, func() error {
+		encodedReader, encodedWriter := io.Pipe()
+		go func() {
+			encodedWriter.CloseWithError(encodeUpload(encodedWriter, pcm()))
+		}()
+		var err error
+		uri, err = saveAudio(ctx, name+uploadExtension(), encodedReader)
+		// stops the encoder when the storage did not read all of it
+		encodedReader.Close()
+		return err
+	})
+	return uri, err
+}
+
+// keepBleepedAudio stores the exported audio of a request which bleepAudio, with its PII bleeped while it is
+// uploaded. The bleeps are offsets into the exported audio.
+func keepBleepedAudio(ctx context.Context, requestId string, request *recognitionRequest, name string, audio *RecognitionAudio, bleeps []bleepRange) error {
+	if !request.bleepAudio || !audio.keep {
+		return nil
+	}
+	exported := audio.exportedSpool()
+	var err error
+	if audio.keptUri, err = uploadAudio(ctx, requestId, name, func() io.Reader {
+		return newBleepReader(exported.open(), bleeps)
+	}); err != nil {
+		return fmt.Errorf("bleeped audio error: %w", err)
+	}
+	return nil
+}
+
+func saveAudio(ctx context.Context, name string, pcmReader io.Reader) (string, error) {
+	if audioStorage == nil {
+		return "", audioStorageError
+	}
+	uri, err := audioStorage.Save(ctx, name, pcmReader)
+	if err != nil {
+		return "", fmt.Errorf("save audio to storage error: %w", err)
+	}
+	return uri, nil
+}
+
+// splitStorageUri splits scheme://bucket/object into bucket and object.
+func splitStorageUri(uri, scheme string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(uri, scheme+"://"), "/", 2)
+	if !strings.HasPrefix(uri, scheme+"://") || len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("unsupported audio uri %v", uri)
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// gcsStorage saves audio to a Google Cloud Storage bucket, sharing one client between requests.
+type gcsStorage struct {
+	bucket      string
+	client      *storage.Client
+	closed      bool
+	clientMutex sync.Mutex
+}
+
+func newGcsStorage(bucket string) *gcsStorage {
+	return &gcsStorage{bucket: bucket}
+}
+
+// getClient creates the client on first use when it could not be created at startup,
+// so the service starts without Google credentials.
+func (s *gcsStorage) getClient() (*storage.Client, error) {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+
+	if s.closed {
+		return nil, errClientClosed
+	}
+	if s.client == nil {
+		client, err := storage.NewClient(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("can not create storage client: %w", err)
+		}
+		s.client = client
+	}
+	return s.client, nil
+}
+
+func (s *gcsStorage) Save(ctx context.Context, name string, content io.Reader) (string, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return "", err
+	}
+
+	objectWriter := client.Bucket(s.bucket).Object(name).NewWriter(ctx)
+
+	doneChan := make(chan struct{})
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(objectWriter, content)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		err = objectWriter.Close()
+		if err != nil {
+			errChan <- err
+			return
+		}
+		close(doneChan)
+	}()
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case err := <-errChan:
+		return "", err
+	case <-doneChan:
+		return fmt.Sprintf("gs://%v/%v", s.bucket, name), nil
+	}
+}
+
+// connect creates the client unless it exists already.
+func (s *gcsStorage) connect() error {
+	_, err := s.getClient()
+	return err
+}
+
+func (s *gcsStorage) healthName() string {
+	return "gcs"
+}
+
+// checkHealth reads an object which does not exist, the bucket tells so when it is reachable.
+func (s *gcsStorage) checkHealth(ctx context.Context) error {
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+	_, err = client.Bucket(s.bucket).Object("health-check").Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *gcsStorage) Close() error {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+
+	s.closed = true
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Close()
+	s.client = nil
+	return err
+}
+
+func (s *gcsStorage) Open(ctx context.Context, uri string) (io.ReadCloser, error) {
+	bucketName, objectName, err := splitStorageUri(uri, "gs")
+	if err != nil {
+		return nil, err
+	}
+	client, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Bucket(bucketName).Object(objectName).NewReader(ctx)
+}
+
+func (s *gcsStorage) Delete(ctx context.Context, uri string) error {
+	bucketName, objectName, err := splitStorageUri(uri, "gs")
+	if err != nil {
+		return err
+	}
+	client, err := s.getClient()
+	if err != nil {
+		return err
+	}
+	err = client.Bucket(bucketName).Object(objectName).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// localStorage saves audio as files in a directory, for on-prem setups and tests.
+type localStorage struct {
+	dir string
+}
+
+func newLocalStorage(dir string) (*localStorage, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &localStorage{dir: dir}, nil
+}
+
+func (s *localStorage) Save(ctx context.Context, name string, content io.Reader) (string, error) {
+	path := filepath.Join(s.dir, filepath.Base(name))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+
+	doneChan := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(file, content)
+		doneChan <- err
+	}()
+	select {
+	case <-ctx.Done():
+		file.Close()
+		os.Remove(path)
+		return "", ctx.Err()
+	case err := <-doneChan:
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+			return "", err
+		}
+	}
+	return (&url.URL{Scheme: "file", Path: path}).String(), nil
+}
+
+func (s *localStorage) Open(ctx context.Context, uri string) (io.ReadCloser, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != "file" {
+		return nil, fmt.Errorf("unsupported audio uri %v", uri)
+	}
+	path := filepath.Clean(parsed.Path)
+	if !strings.HasPrefix(path, s.dir+string(filepath.Separator)) {
+		return nil, fmt.Errorf("audio uri %v is outside of the storage directory", uri)
+	}
+	return os.Open(path)
+}
+
+func (s *localStorage) Delete(ctx context.Context, uri string) error {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != "file" {
+		return fmt.Errorf("unsupported audio uri %v", uri)
+	}
+	path := filepath.Clean(parsed.Path)
+	if !strings.HasPrefix(path, s.dir+string(filepath.Separator)) {
+		return fmt.Errorf("audio uri %v is outside of the storage directory", uri)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"os"
+	"strconv"
+)
+
+// s3Storage saves audio to an S3 compatible bucket (AWS, MinIO, Ceph, ...).
+type s3Storage struct {
+	bucket string
+	client *minio.Client
+}
+
+// newS3StorageFromEnv reads S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY, S3_SECRET_KEY, S3_REGION and S3_USE_SSL.
+func newS3StorageFromEnv() (*s3Storage, error) {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		return nil, errors.New("environment variable S3_ENDPOINT is not set")
+	}
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, errors.New("environment variable S3_BUCKET is not set")
+	}
+	useSsl := true
+	if value, isEnvSet := os.LookupEnv("S3_USE_SSL"); isEnvSet {
+		var err error
+		useSsl, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("environment variable S3_USE_SSL is not a bool: %w", err)
+		}
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY"), ""),
+		Secure: useSsl,
+		Region: os.Getenv("S3_REGION"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Storage{bucket: bucket, client: client}, nil
+}
+
+func (s *s3Storage) Save(ctx context.Context, name string, content io.Reader) (string, error) {
+	_, err := s.client.PutObject(ctx, s.bucket, name, content, -1, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("s3://%v/%v", s.bucket, name), nil
+}
+
+func (s *s3Storage) Open(ctx context.Context, uri string) (io.ReadCloser, error) {
+	bucketName, objectName, err := splitStorageUri(uri, "s3")
+	if err != nil {
+		return nil, err
+	}
+	return s.client.GetObject(ctx, bucketName, objectName, minio.GetObjectOptions{})
+}
+
+func (s *s3Storage) Delete(ctx context.Context, uri string) error {
+	bucketName, objectName, err := splitStorageUri(uri, "s3")
+	if err != nil {
+		return err
+	}
+	return s.client.RemoveObject(ctx, bucketName, objectName, minio.RemoveObjectOptions{})
+}
+
+func (s *s3Storage) healthName() string {
+	return "s3"
+}
+
+// checkHealth reads an object which does not exist, the bucket tells so when it is reachable.
+func (s *s3Storage) checkHealth(ctx context.Context) error {
+	_, err := s.client.StatObject(ctx, s.bucket, "health-check", minio.StatObjectOptions{})
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+// limitedRecognizer takes at most limit of inline audio.
+type limitedRecognizer struct {
+	fakeRecognizer
+	limit time.Duration
+}
+
+func (r *limitedRecognizer) MaxInlineDuration() time.Duration {
+	return r.limit
+}
+
+func TestPrepareAudio(t *testing.T) {
+	storage, err := newLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(storage AudioStorage, encoding AudioEncoding, sampleRate int) {
+		audioStorage, uploadEncoding, uploadSampleRate = storage, encoding, sampleRate
+	}(audioStorage, uploadEncoding, uploadSampleRate)
+	audioStorage, uploadEncoding, uploadSampleRate = storage, EncodingLinear16, 48000
+
+	pcm := vadAudio(3*time.Second, time.Second)
+	trimmed, _ := trimSilence(pcm)
+	tests := []struct {
+		name        string
+		inlineLimit time.Duration
+		trimSilence bool
+		keepAudio   bool
+		content     []byte // inline
+		recognized  []byte // uploaded for the recognizer
+		kept        []byte
+		temporary   bool
+	}{
+		{"inline", time.Minute, false, false, pcm, nil, nil, false},
+		{"inline kept", time.Minute, false, true, pcm, nil, pcm, false},
+		{"uploaded", time.Second, false, false, nil, pcm, pcm, false},
+		{"uploaded kept", time.Second, false, true, nil, pcm, pcm, false},
+		{"trimmed inline", time.Minute, true, false, trimmed, nil, nil, false},
+		{"trimmed inline kept untrimmed", time.Minute, true, true, trimmed, nil, pcm, false},
+		{"trimmed uploaded temporarily", time.Second, true, false, nil, trimmed, nil, true},
+		{"trimmed uploaded, kept untrimmed", time.Second, true, true, nil, trimmed, pcm, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &recognitionRequest{
+				recognizer:  &limitedRecognizer{limit: test.inlineLimit},
+				trimSilence: test.trimSilence,
+				keepAudio:   test.keepAudio,
+			}
+			audio, err := prepareAudio(context.Background(), "r", request, test.name, bytes.NewReader(pcm), func() {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if audio.Inline != (test.recognized == nil) || !bytes.Equal(audio.Content, test.content) {
+				t.Errorf("inline %v with %v bytes, want %v bytes", audio.Inline, len(audio.Content), len(test.content))
+			}
+			stored := func(uri string) []byte {
+				if uri == "" {
+					return nil
+				}
+				content, err := readStoredAudio(context.Background(), uri)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return content
+			}
+			if recognized := stored(audio.Uri); !bytes.Equal(recognized, test.recognized) {
+				t.Errorf("uploaded %v bytes for the recognizer, want %v", len(recognized), len(test.recognized))
+			}
+			if kept := stored(audio.keptUri); !bytes.Equal(kept, test.kept) {
+				t.Errorf("kept %v bytes, want %v", len(kept), len(test.kept))
+			}
+
+			audio.release()
+			if test.temporary {
+				if _, err := audioStorage.Open(context.Background(), audio.Uri); err == nil {
+					t.Errorf("temporary audio %v not deleted", audio.Uri)
+				}
+			}
+		})
+	}
+}
+
+func TestPrepareEmptyAudio(t *testing.T) {
+	request := &recognitionRequest{recognizer: &limitedRecognizer{limit: time.Minute}}
+	audio, err := prepareAudio(context.Background(), "r", request, "empty", bytes.NewReader(nil), func() {
+		t.Error("empty audio uploaded")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audio.release()
+	if !audio.Inline || len(audio.Content) != 0 || audio.Uri != "" {
+		t.Errorf("inline %v with %v bytes at %q, want inline without bytes", audio.Inline, len(audio.Content), audio.Uri)
+	}
+	content, err := audio.content(context.Background())
+	if err != nil || len(content) != 0 {
+		t.Errorf("content %v bytes, error %v", len(content), err)
+	}
+}
+
+func TestKeepBleepedAudio(t *testing.T) {
+	storage, err := newLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(storage AudioStorage, encoding AudioEncoding, sampleRate int) {
+		audioStorage, uploadEncoding, uploadSampleRate = storage, encoding, sampleRate
+	}(audioStorage, uploadEncoding, uploadSampleRate)
+	audioStorage, uploadEncoding, uploadSampleRate = storage, EncodingLinear16, 48000
+
+	pcm := vadAudio(time.Second, 2*time.Second)
+	bleeps := []bleepRange{{start: 1500 * time.Millisecond, end: 2 * time.Second}}
+	bleeped := append([]byte(nil), pcm...)
+	bleep(bleeped, bleeps)
+
+	tests := []struct {
+		name        string
+		inlineLimit time.Duration
+		keepAudio   bool
+		recognized  bool // uploaded temporarily
+		kept        []byte
+	}{
+		{"inline", time.Minute, false, false, nil},
+		{"inline kept", time.Minute, true, false, bleeped},
+		{"uploaded", time.Second, false, true, bleeped},
+		{"uploaded kept", time.Second, true, true, bleeped},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &recognitionRequest{
+				recognizer: &limitedRecognizer{limit: test.inlineLimit},
+				keepAudio:  test.keepAudio,
+				redactPii:  true,
+				bleepAudio: true,
+			}
+			audio, err := prepareAudio(context.Background(), "r", request, test.name, bytes.NewReader(pcm), func() {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if audio.keptUri != "" {
+				t.Errorf("audio with PII stored before bleeping as %v", audio.keptUri)
+			}
+			if (audio.Uri != "") != test.recognized || audio.temporary != test.recognized {
+				t.Errorf("uploaded for the recognizer as %q, temporary %v, want %v", audio.Uri, audio.temporary, test.recognized)
+			}
+
+			if err := keepBleepedAudio(context.Background(), "r", request, test.name, audio, bleeps); err != nil {
+				t.Fatal(err)
+			}
+			var kept []byte
+			if audio.keptUri != "" {
+				if kept, err = readStoredAudio(context.Background(), audio.keptUri); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(kept, test.kept) {
+				t.Errorf("kept %v bytes, want %v bleeped bytes", len(kept), len(test.kept))
+			}
+
+			audio.release()
+			if test.recognized {
+				if _, err := audioStorage.Open(context.Background(), audio.Uri); err == nil {
+					t.Errorf("unbleeped audio %v not deleted", audio.Uri)
+				}
+			}
+		})
+	}
+}
+
+func TestTemporaryAudioTracking(t *testing.T) {
+	useResultStore(t)
+	storage, err := newLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(storage AudioStorage, encoding AudioEncoding, sampleRate int) {
+		audioStorage, uploadEncoding, uploadSampleRate = storage, encoding, sampleRate
+	}(audioStorage, uploadEncoding, uploadSampleRate)
+	audioStorage, uploadEncoding, uploadSampleRate = storage, EncodingLinear16, 48000
+
+	requestId := results.Create(&Result{Time: time.Now(), Status: StatusQueued}).RequestId
+	temporaryUris := func() ([]string, string) {
+		result, _ := results.Get(requestId)
+		return result.TemporaryAudioUris, result.TemporaryAudioError
+	}
+	request := &recognitionRequest{recognizer: &limitedRecognizer{limit: time.Second}, trimSilence: true}
+	audio, err := prepareAudio(context.Background(), requestId, request, "tracked", bytes.NewReader(vadAudio(3*time.Second, time.Second)), func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uris, _ := temporaryUris(); len(uris) != 1 || uris[0] != audio.Uri {
+		t.Fatalf("temporary uris %v, want %v", uris, audio.Uri)
+	}
+	audio.release()
+	audio.release()
+	if uris, message := temporaryUris(); uris != nil || message != "" {
+		t.Errorf("temporary uris %v (%q) after release", uris, message)
+	}
+
+	// left by a stopped process: one is still stored, one can not be deleted
+	left, err := storage.Save(context.Background(), "left-recognized.wav", bytes.NewReader([]byte("audio")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside := "file:///outside/left-recognized.wav"
+	results.Update(requestId, func(result *Result) {
+		result.TemporaryAudioUris = []string{left, outside}
+	})
+	deleteLeftTemporaryAudio()
+	if _, err := storage.Open(context.Background(), left); err == nil {
+		t.Errorf("left temporary audio %v not deleted", left)
+	}
+	if uris, message := temporaryUris(); len(uris) != 1 || uris[0] != outside || message == "" {
+		t.Errorf("temporary uris %v (%q), want %v with its error", uris, message, outside)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"strings"
+	"time"
+)
+
+// Segment is a stretch of recognized speech, timed in milliseconds from the start of the recognized audio, or from
+// From for conversations, whose segments carry their Endpoint.
+// Every recognizer maps its results into segments, so the result schema does not depend on the provider.
+type Segment struct {
+	Endpoint     string `json:",omitempty"`
+	StartMs      int64
+	EndMs        int64
+	Text         string
+	Confidence   float32
+	LanguageCode string `json:",omitempty"`
+	Words        []Word `json:",omitempty"`
+}
+
+// Word is a recognized word of a segment, present when the recognizer reports word offsets.
+type Word struct {
+	Word       string
+	StartMs    int64
+	EndMs      int64
+	Confidence float32 `json:",omitempty"`
+}
+
+func (s *Segment) start() time.Duration {
+	return time.Duration(s.StartMs) * time.Millisecond
+}
+
+func (s *Segment) end() time.Duration {
+	return time.Duration(s.EndMs) * time.Millisecond
+}
+
+func (w *Word) start() time.Duration {
+	return time.Duration(w.StartMs) * time.Millisecond
+}
+
+func (w *Word) end() time.Duration {
+	return time.Duration(w.EndMs) * time.Millisecond
+}
+
+// segmentsFromSpeechResults maps Google recognition results, a segment starts where the previous result ended.
+func segmentsFromSpeechResults(recognitionResults []*speechpb.SpeechRecognitionResult) []Segment {
+	segments := make([]Segment, 0, len(recognitionResults))
+	var resultStart time.Duration
+	for _, recognitionResult := range recognitionResults {
+		resultEnd := recognitionResult.ResultEndTime.AsDuration()
+		if len(recognitionResult.Alternatives) == 0 {
+			resultStart = resultEnd
+			continue
+		}
+		alternative := recognitionResult.Alternatives[0]
+		segment := Segment{
+			StartMs:      resultStart.Milliseconds(),
+			EndMs:        resultEnd.Milliseconds(),
+			Text:         strings.TrimSpace(alternative.Transcript),
+			Confidence:   alternative.Confidence,
+			LanguageCode: recognitionResult.LanguageCode,
+		}
+		for _, word := range alternative.Words {
+			segment.Words = append(segment.Words, Word{
+				Word:       word.Word,
+				StartMs:    word.StartTime.AsDuration().Milliseconds(),
+				EndMs:      word.EndTime.AsDuration().Milliseconds(),
+				Confidence: word.Confidence,
+			})
+		}
+		if len(segment.Words) > 0 {
+			segment.StartMs = segment.Words[0].StartMs
+		}
+		segments = append(segments, segment)
+		resultStart = resultEnd
+	}
+	return segments
+}
+
+// speechResults maps segments back to the speechpb shape of RecognitionResults, kept for legacyResults clients.
+func speechResults(segments []Segment) []*speechpb.SpeechRecognitionResult {
+	recognitionResults := make([]*speechpb.SpeechRecognitionResult, 0, len(segments))
+	for _, segment := range segments {
+		alternative := &speechpb.SpeechRecognitionAlternative{
+			Transcript: segment.Text,
+			Confidence: segment.Confidence,
+		}
+		for _, word := range segment.Words {
+			alternative.Words = append(alternative.Words, &speechpb.WordInfo{
+				StartTime:  durationpb.New(word.start()),
+				EndTime:    durationpb.New(word.end()),
+				Word:       word.Word,
+				Confidence: word.Confidence,
+			})
+		}
+		recognitionResults = append(recognitionResults, &speechpb.SpeechRecognitionResult{
+			Alternatives:  []*speechpb.SpeechRecognitionAlternative{alternative},
+			ResultEndTime: durationpb.New(segment.end()),
+			LanguageCode:  segment.LanguageCode,
+		})
+	}
+	return recognitionResults
+}
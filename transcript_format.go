@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// captionMaxDuration and captionMaxLength split long speech into cues which fit on screen
+const captionMaxDuration = time.Second * 7
+const captionMaxLength = 84
+
+// resultFormats are the formats of GET /speech-to-text; srt, vtt and txt render the transcript only
+var resultFormats = map[string]bool{"json": true, "srt": true, "vtt": true, "txt": true}
+
+// captionCue is a caption timed by offsets from the start of the recognized audio.
+type captionCue struct {
+	start, end time.Duration
+	speaker    string
+	text       string
+}
+
+// writeResultFormat renders a done result as srt, vtt or txt.
+func writeResultFormat(result Result, format string, w http.ResponseWriter) {
+	var contentType string
+	var render func(cues []captionCue) []byte
+	switch format {
+	case "srt":
+		contentType, render = "application/x-subrip; charset=utf-8", renderSrt
+	case "vtt":
+		contentType, render = "text/vtt; charset=utf-8", renderVtt
+	case "txt":
+		contentType, render = "text/plain; charset=utf-8", renderTxt
+	default:
+		http.Error(w, fmt.Sprintf("format param error, unknown format %v", format), http.StatusBadRequest)
+		return
+	}
+	if result.Status != StatusDone {
+		http.Error(w, fmt.Sprintf("Result is %v, not %v", result.Status, StatusDone), http.StatusConflict)
+		return
+	}
+
+	var cues []captionCue
+	if result.Transcript != nil || result.Endpoints != nil {
+		cues = transcriptCues(result)
+	} else {
+		cues = recognitionCues(result)
+	}
+
+	w.Header().Add("Content-Type", contentType)
+	if _, err := w.Write(render(cues)); err != nil {
+		fmt.Printf("Can not write response: %v", err.Error())
+	}
+}
+
+// recognitionCues splits the segments of one endpoint into cues on pauses between words
+// and when a cue gets too long. Segments without word offsets are split by splitCue.
+func recognitionCues(result Result) []captionCue {
+	var cues []captionCue
+	for _, segment := range result.Segments {
+		if len(segment.Words) == 0 {
+			if segment.Text != "" {
+				cues = append(cues, splitCue(captionCue{start: segment.start(), end: segment.end(), text: segment.Text})...)
+			}
+			continue
+		}
+
+		cue := -1
+		for _, word := range segment.Words {
+			if cue < 0 || word.start()-cues[cue].end > transcriptPause || word.end()-cues[cue].start > captionMaxDuration ||
+				len(cues[cue].text)+1+len(word.Word) > captionMaxLength {
+				cues = append(cues, captionCue{start: word.start(), text: word.Word})
+				cue = len(cues) - 1
+			} else {
+				cues[cue].text += " " + word.Word
+			}
+			cues[cue].end = word.end()
+		}
+	}
+	return cues
+}
+
+// transcriptCues times the conversation transcript from the start of its window.
+func transcriptCues(result Result) []captionCue {
+	var origin time.Time
+	if result.From != nil {
+		origin = *result.From
+	} else if len(result.Transcript) > 0 {
+		origin = result.Transcript[0].StartTime
+	}
+	cues := make([]captionCue, 0, len(result.Transcript))
+	for _, entry := range result.Transcript {
+		cues = append(cues, splitCue(captionCue{
+			start:   maxDuration(0, entry.StartTime.Sub(origin)),
+			end:     maxDuration(0, entry.EndTime.Sub(origin)),
+			speaker: entry.Endpoint,
+			text:    entry.Text,
+		})...)
+	}
+	return cues
+}
+
+// splitCue splits a cue without word offsets into cues within captionMaxDuration and captionMaxLength,
+// timing the words by their position in the text.
+func splitCue(cue captionCue) []captionCue {
+	words := strings.Fields(cue.text)
+	text := strings.Join(words, " ")
+	at := func(position int) time.Duration {
+		if len(text) == 0 {
+			return cue.start
+		}
+		return cue.start + (cue.end-cue.start)*time.Duration(position)/time.Duration(len(text))
+	}
+
+	var cues []captionCue
+	position := 0
+	for _, word := range words {
+		start, end := at(position), at(position+len(word))
+		last := len(cues) - 1
+		if last < 0 || end-cues[last].start > captionMaxDuration || len(cues[last].text)+1+len(word) > captionMaxLength {
+			cues = append(cues, captionCue{start: start, speaker: cue.speaker, text: word})
+			last++
+		} else {
+			cues[last].text += " " + word
+		}
+		cues[last].end = end
+		position += len(word) + 1
+	}
+	return cues
+}
+
+func renderSrt(cues []captionCue) []byte {
+	var b bytes.Buffer
+	for i, cue := range cues {
+		fmt.Fprintf(&b, "%d\n%s --> %s\n", i+1, formatCueTime(cue.start, ","), formatCueTime(cue.end, ","))
+		if cue.speaker != "" {
+			fmt.Fprintf(&b, "%s: ", cue.speaker)
+		}
+		fmt.Fprintf(&b, "%s\n\n", cue.text)
+	}
+	return b.Bytes()
+}
+
+func renderVtt(cues []captionCue) []byte {
+	var b bytes.Buffer
+	b.WriteString("WEBVTT\n\n")
+	for _, cue := range cues {
+		fmt.Fprintf(&b, "%s --> %s\n", formatCueTime(cue.start, "."), formatCueTime(cue.end, "."))
+		if cue.speaker != "" {
+			fmt.Fprintf(&b, "<v %s>", escapeVtt(cue.speaker))
+		}
+		fmt.Fprintf(&b, "%s\n\n", escapeVtt(cue.text))
+	}
+	return b.Bytes()
+}
+
+// vttEscaper escapes the characters WebVTT cue text reserves for tags and entities, which also breaks up "-->",
+// and keeps a cue on one line, as a blank line would end it.
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", " ", "\n", " ")
+
+func escapeVtt(text string) string {
+	return vttEscaper.Replace(text)
+}
+
+func renderTxt(cues []captionCue) []byte {
+	var b bytes.Buffer
+	for _, cue := range cues {
+		if cue.speaker != "" {
+			fmt.Fprintf(&b, "%s: ", cue.speaker)
+		}
+		fmt.Fprintf(&b, "%s\n", cue.text)
+	}
+	return b.Bytes()
+}
+
+// formatCueTime formats hh:mm:ss followed by the separator and milliseconds.
+func formatCueTime(offset time.Duration, separator string) string {
+	ms := offset.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, separator, ms%1000)
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
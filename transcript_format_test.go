@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatCueTime(t *testing.T) {
+	tests := []struct {
+		offset    time.Duration
+		separator string
+		want      string
+	}{
+		{0, ",", "00:00:00,000"},
+		{time.Millisecond * 1500, ".", "00:00:01.500"},
+		{time.Minute*61 + time.Second*2 + time.Millisecond*3, ",", "01:01:02,003"},
+		{time.Hour * 100, ".", "100:00:00.000"},
+		{time.Microsecond * 999, ",", "00:00:00,000"},
+	}
+	for _, test := range tests {
+		if got := formatCueTime(test.offset, test.separator); got != test.want {
+			t.Errorf("formatCueTime(%v) = %v, want %v", test.offset, got, test.want)
+		}
+	}
+}
+
+func TestRecognitionCues(t *testing.T) {
+	word := func(text string, startMs, endMs int64) Word {
+		return Word{Word: text, StartMs: startMs, EndMs: endMs}
+	}
+	long := strings.Repeat("x", 40)
+	tests := []struct {
+		name  string
+		words []Word
+		texts []string
+	}{
+		{"one cue", []Word{word("a", 0, 100), word("b", 200, 300)}, []string{"a b"}},
+		{"pause", []Word{word("a", 0, 100), word("b", 1200, 1300)}, []string{"a", "b"}},
+		{"max duration", []Word{word("a", 0, 3000), word("b", 3000, 6000), word("c", 6000, 9000)}, []string{"a b", "c"}},
+		{"max length", []Word{word(long, 0, 100), word(long, 100, 200), word(long, 200, 300)}, []string{long + " " + long, long}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cues := recognitionCues(Result{Segments: []Segment{{Words: test.words}}})
+			if len(cues) != len(test.texts) {
+				t.Fatalf("%v cues, want %v", len(cues), len(test.texts))
+			}
+			for i, cue := range cues {
+				if cue.text != test.texts[i] {
+					t.Errorf("cue %v text %q, want %q", i, cue.text, test.texts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSplitCue(t *testing.T) {
+	// a monologue of 100 words over 50s, 500 characters
+	text := strings.TrimSpace(strings.Repeat("word ", 100))
+	cues := splitCue(captionCue{start: time.Second, end: time.Second * 51, speaker: "e1", text: text})
+
+	var words []string
+	for i, cue := range cues {
+		if len(cue.text) > captionMaxLength {
+			t.Errorf("cue %v has %v characters", i, len(cue.text))
+		}
+		if cue.end-cue.start > captionMaxDuration {
+			t.Errorf("cue %v lasts %v", i, cue.end-cue.start)
+		}
+		if i > 0 && cue.start < cues[i-1].end {
+			t.Errorf("cue %v starts at %v before the previous one ends at %v", i, cue.start, cues[i-1].end)
+		}
+		if cue.speaker != "e1" {
+			t.Errorf("cue %v speaker %q", i, cue.speaker)
+		}
+		words = append(words, cue.text)
+	}
+	if strings.Join(words, " ") != text {
+		t.Error("cues do not add up to the text")
+	}
+	if cues[0].start != time.Second || cues[len(cues)-1].end != time.Second*51 {
+		t.Errorf("cues span %v to %v, want 1s to 51s", cues[0].start, cues[len(cues)-1].end)
+	}
+
+	if cues := splitCue(captionCue{start: time.Second, end: time.Second * 2, text: "short"}); len(cues) != 1 || cues[0].text != "short" {
+		t.Errorf("short cue split into %+v", cues)
+	}
+}
+
+func TestTranscriptCuesSplitLongEntries(t *testing.T) {
+	from := time.Unix(1000, 0)
+	result := Result{From: &from, Transcript: []TranscriptEntry{{
+		Endpoint:  "e1",
+		StartTime: from.Add(time.Second * 10),
+		EndTime:   from.Add(time.Second * 40),
+		Text:      strings.TrimSpace(strings.Repeat("talking ", 60)),
+	}}}
+	cues := transcriptCues(result)
+	if len(cues) < 5 {
+		t.Fatalf("monologue split into %v cues", len(cues))
+	}
+	if cues[0].start != time.Second*10 {
+		t.Errorf("first cue starts at %v, want 10s", cues[0].start)
+	}
+}
+
+func TestRenderVttEscapes(t *testing.T) {
+	vtt := string(renderVtt([]captionCue{{end: time.Second, speaker: "<b>", text: "a --> b & <i>c</i>\n\nd"}}))
+	want := "WEBVTT\n\n00:00:00.000 --> 00:00:01.000\n<v &lt;b&gt;>a --&gt; b &amp; &lt;i&gt;c&lt;/i&gt;  d\n\n"
+	if vtt != want {
+		t.Errorf("vtt %q, want %q", vtt, want)
+	}
+}
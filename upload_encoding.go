@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	gst "rtp-audio-processor/gstreamer-src"
+	"strconv"
+)
+
+// AudioEncoding is the encoding of uploaded audio.
+type AudioEncoding string
+
+const (
+	EncodingLinear16 AudioEncoding = "linear16"
+	EncodingFlac     AudioEncoding = "flac"
+)
+
+// uploadEncoding and uploadSampleRate are set by UPLOAD_ENCODING (flac or linear16, flac by default)
+// and UPLOAD_SAMPLE_RATE (16000 by default, a divisor of 48000).
+var uploadEncoding AudioEncoding
+var uploadSampleRate int
+
+func init() {
+	uploadEncoding = EncodingFlac
+	if value, isEnvSet := os.LookupEnv("UPLOAD_ENCODING"); isEnvSet {
+		uploadEncoding = AudioEncoding(value)
+		if uploadEncoding != EncodingFlac && uploadEncoding != EncodingLinear16 {
+			panic(fmt.Sprintf("environment variable UPLOAD_ENCODING has unknown value %v", value))
+		}
+	}
+	uploadSampleRate = 16000
+	if value, isEnvSet := os.LookupEnv("UPLOAD_SAMPLE_RATE"); isEnvSet {
+		var err error
+		uploadSampleRate, err = strconv.Atoi(value)
+		if err != nil || uploadSampleRate <= 0 || gst.SampleRate%uploadSampleRate != 0 {
+			panic(fmt.Sprintf("environment variable UPLOAD_SAMPLE_RATE is not a divisor of %v: %v", gst.SampleRate, value))
+		}
+	}
+}
+
+// uploadExtension is the file extension of uploadEncoding.
+func uploadExtension() string {
+	if uploadEncoding == EncodingFlac {
+		return ".flac"
+	}
+	return ".pcm"
+}
+
+// encodeUpload resamples and encodes exported 48kHz LINEAR16 audio for upload by GStreamer, streaming it from pcm to w.
+func encodeUpload(w io.Writer, pcm io.Reader) error {
+	if uploadEncoding == EncodingLinear16 && uploadSampleRate == gst.SampleRate {
+		_, err := io.Copy(w, pcm)
+		return err
+	}
+	description := fmt.Sprintf("audioresample ! audio/x-raw,format=S16LE,rate=%d", uploadSampleRate)
+	if uploadEncoding == EncodingFlac {
+		description += " ! flacenc"
+	}
+	encoder, err := gst.NewEncoder(w, description)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(encoder, pcm); err != nil {
+		encoder.Close()
+		return err
+	}
+	return encoder.Close()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	gst "rtp-audio-processor/gstreamer-src"
+	"sort"
+	"time"
+)
+
+// vadFrame is the audio analyzed at once by the voice activity detection
+const vadFrame = time.Millisecond * 20
+
+// vadThreshold is the RMS amplitude of 16 bit samples counted as speech, about -40 dBFS
+const vadThreshold = 330
+
+// vadPadding is kept around speech, so quiet starts and ends of words are not clipped
+const vadPadding = time.Millisecond * 300
+
+// vadMaxSilence is the longest silence left in trimmed audio, longer ones are cut down to it
+const vadMaxSilence = time.Millisecond * 500
+
+// silenceTrim maps offsets into trimmed audio back to offsets into the original audio.
+type silenceTrim struct {
+	cuts    []trimCut
+	removed time.Duration
+}
+
+// trimCut starts a stretch of audio which was kept in one piece.
+type trimCut struct {
+	trimmed  time.Duration
+	original time.Duration
+}
+
+// trimSilence shortens silences in 48kHz mono LINEAR16 audio to vadMaxSilence.
+func trimSilence(pcm []byte) ([]byte, *silenceTrim) {
+	var trimmed bytes.Buffer
+	trimmer := newSilenceTrimmer(&trimmed)
+	trimmer.Write(pcm)
+	trimmer.Close()
+	return trimmed.Bytes(), trimmer.trim
+}
+
+// silenceTrimmer shortens silences like trimSilence while the audio is written to it, writing the trimmed audio
+// to out. Whether a frame is kept depends on the padding after it, so out lags behind by the padding until Close.
+type silenceTrimmer struct {
+	out        io.Writer
+	trim       *silenceTrim
+	frameBytes int
+	partial    []byte   // written after the last complete frame
+	pending    [][]byte // frames waiting for the padding after them
+	frames     int      // complete frames written
+	lastSpeech int      // the last frame with speech
+	silence    int      // silent frames kept in a row
+	cut        bool
+	original   int // bytes of audio written
+	written    int // bytes of trimmed audio
+	err        error
+}
+
+func newSilenceTrimmer(out io.Writer) *silenceTrimmer {
+	return &silenceTrimmer{
+		out:        out,
+		trim:       &silenceTrim{cuts: []trimCut{{}}},
+		frameBytes: int(vadFrame*gst.SampleRate/time.Second) * gst.BytesPerSample,
+		lastSpeech: -int(vadPadding/vadFrame) - 1,
+	}
+}
+
+func (t *silenceTrimmer) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := t.frameBytes - len(t.partial)
+		if n > len(p) {
+			n = len(p)
+		}
+		t.partial = append(t.partial, p[:n]...)
+		p = p[n:]
+		if len(t.partial) == t.frameBytes {
+			t.addFrame(t.partial)
+			t.partial = nil
+		}
+	}
+	if t.err != nil {
+		return 0, t.err
+	}
+	return written, nil
+}
+
+// Close trims the rest of the audio, a last frame may be shorter.
+func (t *silenceTrimmer) Close() error {
+	if len(t.partial) > 0 {
+		t.addFrame(t.partial)
+		t.partial = nil
+	}
+	for i, frame := range t.pending {
+		t.keep(frame, t.frames-len(t.pending)+i)
+	}
+	t.pending = nil
+	t.trim.removed = pcmDuration(t.original - t.written)
+	return t.err
+}
+
+func (t *silenceTrimmer) addFrame(frame []byte) {
+	if frameRms(frame) >= vadThreshold {
+		t.lastSpeech = t.frames
+	}
+	t.frames++
+	t.original += len(frame)
+	t.pending = append(t.pending, frame)
+	if padding := int(vadPadding / vadFrame); len(t.pending) > padding {
+		t.keep(t.pending[0], t.frames-len(t.pending))
+		t.pending = t.pending[1:]
+	}
+}
+
+// keep writes frame i out unless it is in a silence longer than vadMaxSilence. All frames up to the padding after
+// frame i have been added, so it is speech (widened by the padding) when the last speech is at most padding before.
+func (t *silenceTrimmer) keep(frame []byte, i int) {
+	if t.lastSpeech >= i-int(vadPadding/vadFrame) {
+		t.silence = 0
+	} else if t.silence++; t.silence > int(vadMaxSilence/vadFrame) {
+		t.cut = true
+		return
+	}
+	if t.cut {
+		t.trim.cuts = append(t.trim.cuts, trimCut{
+			trimmed:  pcmDuration(t.written),
+			original: pcmDuration(i * t.frameBytes),
+		})
+		t.cut = false
+	}
+	if t.err == nil {
+		_, t.err = t.out.Write(frame)
+	}
+	t.written += len(frame)
+}
+
+func frameRms(frame []byte) float64 {
+	samples := len(frame) / 2
+	if samples == 0 {
+		return 0
+	}
+	var sum float64
+	for i := 0; i < samples; i++ {
+		sample := float64(int16(binary.LittleEndian.Uint16(frame[i*2:])))
+		sum += sample * sample
+	}
+	return math.Sqrt(sum / float64(samples))
+}
+
+func pcmDuration(bytes int) time.Duration {
+	return time.Duration(bytes/gst.BytesPerSample) * time.Second / gst.SampleRate
+}
+
+// originalOffset maps an offset into the trimmed audio to the original audio.
+func (t *silenceTrim) originalOffset(offset time.Duration) time.Duration {
+	i := sort.Search(len(t.cuts), func(i int) bool {
+		// offsets before the audio, e.g. of padded words, map by the first stretch too
+		return t.cuts[i].trimmed > offset && t.cuts[i].trimmed > 0
+	})
+	cut := t.cuts[i-1]
+	return cut.original + offset - cut.trimmed
+}
+
+// restore maps the offsets of segments recognized in the trimmed audio to the original audio.
+func (t *silenceTrim) restore(segments []Segment) {
+	restoreMs := func(ms int64) int64 {
+		return t.originalOffset(time.Duration(ms) * time.Millisecond).Milliseconds()
+	}
+	for i := range segments {
+		segments[i].StartMs = restoreMs(segments[i].StartMs)
+		segments[i].EndMs = restoreMs(segments[i].EndMs)
+		for j := range segments[i].Words {
+			segments[i].Words[j].StartMs = restoreMs(segments[i].Words[j].StartMs)
+			segments[i].Words[j].EndMs = restoreMs(segments[i].Words[j].EndMs)
+		}
+	}
+}
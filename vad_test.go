@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	gst "rtp-audio-processor/gstreamer-src"
+	"testing"
+	"time"
+)
+
+// vadAudio makes audio of alternating silence and speech (a loud square wave), starting with silence.
+func vadAudio(durations ...time.Duration) []byte {
+	var pcm []byte
+	for i, duration := range durations {
+		samples := make([]byte, int(duration*gst.SampleRate/time.Second)*gst.BytesPerSample)
+		if i%2 == 1 {
+			for j := 0; j < len(samples); j += gst.BytesPerSample {
+				value := int16(2000)
+				if j/gst.BytesPerSample%48 < 24 {
+					value = -value
+				}
+				binary.LittleEndian.PutUint16(samples[j:], uint16(value))
+			}
+		}
+		pcm = append(pcm, samples...)
+	}
+	return pcm
+}
+
+func TestTrimSilence(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name    string
+		pcm     []byte
+		trimmed time.Duration
+		cuts    []trimCut
+	}{
+		{"empty", nil, 0, []trimCut{{}}},
+		{"speech only", vadAudio(0, 2*time.Second), 2 * time.Second, []trimCut{{}}},
+		{"short silences kept", vadAudio(500*ms, time.Second, 1100*ms, time.Second), 3600 * ms, []trimCut{{}}},
+		{
+			// the silence before the padding of the speech is cut down to vadMaxSilence
+			name:    "silence at the start",
+			pcm:     vadAudio(3*time.Second, time.Second),
+			trimmed: vadMaxSilence + vadPadding + time.Second,
+			cuts:    []trimCut{{}, {trimmed: vadMaxSilence, original: 3*time.Second - vadPadding}},
+		},
+		{
+			name:    "silence between speech",
+			pcm:     vadAudio(0, time.Second, 5*time.Second, time.Second),
+			trimmed: time.Second + vadPadding + vadMaxSilence + vadPadding + time.Second,
+			cuts:    []trimCut{{}, {trimmed: time.Second + vadPadding + vadMaxSilence, original: 6*time.Second - vadPadding}},
+		},
+		{
+			name:    "silence at the end",
+			pcm:     vadAudio(0, time.Second, 3*time.Second),
+			trimmed: time.Second + vadPadding + vadMaxSilence,
+			cuts:    []trimCut{{}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trimmed, trim := trimSilence(test.pcm)
+			if duration := pcmDuration(len(trimmed)); duration != test.trimmed {
+				t.Errorf("trimmed to %v, want %v", duration, test.trimmed)
+			}
+			if removed := pcmDuration(len(test.pcm)) - test.trimmed; trim.removed != removed {
+				t.Errorf("removed %v, want %v", trim.removed, removed)
+			}
+			if len(trim.cuts) != len(test.cuts) {
+				t.Fatalf("cuts %+v, want %+v", trim.cuts, test.cuts)
+			}
+			for i := range trim.cuts {
+				if trim.cuts[i] != test.cuts[i] {
+					t.Errorf("cuts %+v, want %+v", trim.cuts, test.cuts)
+				}
+			}
+		})
+	}
+}
+
+func TestSilenceTrimmerStreams(t *testing.T) {
+	pcm := vadAudio(3*time.Second, time.Second, 5*time.Second, time.Second, 2*time.Second)
+	want, wantTrim := trimSilence(pcm)
+
+	spool := newAudioSpool(int64(len(pcm)))
+	trimmer := newSilenceTrimmer(spool)
+	// writes of odd sizes, splitting frames and samples
+	for i := 0; i < len(pcm); i += 1001 {
+		end := i + 1001
+		if end > len(pcm) {
+			end = len(pcm)
+		}
+		trimmer.Write(pcm[i:end])
+	}
+	if err := trimmer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(spool.bytes()) != string(want) || trimmer.trim.removed != wantTrim.removed || len(trimmer.trim.cuts) != len(wantTrim.cuts) {
+		t.Errorf("streamed trim differs: %v bytes removing %v, want %v bytes removing %v",
+			spool.size, trimmer.trim.removed, len(want), wantTrim.removed)
+	}
+}
+
+func TestOriginalOffset(t *testing.T) {
+	ms := time.Millisecond
+	trim := &silenceTrim{cuts: []trimCut{{}, {trimmed: 0, original: 2 * time.Second}, {trimmed: 3 * time.Second, original: 10 * time.Second}}}
+	tests := []struct {
+		offset, original time.Duration
+	}{
+		{-100 * ms, 1900 * ms}, // before the audio
+		{0, 2 * time.Second},   // silence cut at the very start
+		{1500 * ms, 3500 * ms},
+		{3 * time.Second, 10 * time.Second},
+		{4 * time.Second, 11 * time.Second},
+	}
+	for _, test := range tests {
+		if original := trim.originalOffset(test.offset); original != test.original {
+			t.Errorf("originalOffset(%v) = %v, want %v", test.offset, original, test.original)
+		}
+	}
+
+	segments := []Segment{{StartMs: 500, EndMs: 3500, Words: []Word{{Word: "a", StartMs: 500, EndMs: 3500}}}}
+	trim.restore(segments)
+	if segment := segments[0]; segment.StartMs != 2500 || segment.EndMs != 10500 || segment.Words[0].StartMs != 2500 || segment.Words[0].EndMs != 10500 {
+		t.Errorf("restored segment %+v", segment)
+	}
+}
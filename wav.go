@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+func writeWavHeader(w io.Writer, channels, sampleRate, bitsPerSample, dataSize int) error {
+	blockAlign := channels * bitsPerSample / 8
+	header := struct {
+		ChunkId       [4]byte
+		ChunkSize     uint32
+		Format        [4]byte
+		Subchunk1Id   [4]byte
+		Subchunk1Size uint32
+		AudioFormat   uint16
+		NumChannels   uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+		Subchunk2Id   [4]byte
+		Subchunk2Size uint32
+	}{
+		ChunkId:       [4]byte{'R', 'I', 'F', 'F'},
+		ChunkSize:     uint32(36 + dataSize),
+		Format:        [4]byte{'W', 'A', 'V', 'E'},
+		Subchunk1Id:   [4]byte{'f', 'm', 't', ' '},
+		Subchunk1Size: 16,
+		AudioFormat:   1, // PCM
+		NumChannels:   uint16(channels),
+		SampleRate:    uint32(sampleRate),
+		ByteRate:      uint32(sampleRate * blockAlign),
+		BlockAlign:    uint16(blockAlign),
+		BitsPerSample: uint16(bitsPerSample),
+		Subchunk2Id:   [4]byte{'d', 'a', 't', 'a'},
+		Subchunk2Size: uint32(dataSize),
+	}
+	return binary.Write(w, binary.LittleEndian, &header)
+}